@@ -91,7 +91,7 @@ echo "$domain" > /etc/zivpn/domain
 echo "$api_key" > /etc/zivpn/apikey
 run_silent "Configuring" "wget -q https://raw.githubusercontent.com/ramadhan144/ZIVPNB/main/config.json -O /etc/zivpn/config.json"
 
-run_silent "Generating SSL" "openssl req -new -newkey rsa:4096 -days 365 -nodes -x509 -subj '/C=ID/ST=Jawa Barat/L=Bandung/O=AutoFTbot/OU=IT Department/CN=$domain' -keyout /etc/zivpn/zivpn.key -out /etc/zivpn/zivpn.crt"
+run_silent "Generating SSL" "openssl req -new -newkey rsa:4096 -days 365 -nodes -x509 -subj '/C=ID/ST=Jawa Barat/L=Bandung/O=AutoFTbot/OU=IT Department/CN=$domain' -addext 'subjectAltName=DNS:$domain' -keyout /etc/zivpn/zivpn.key -out /etc/zivpn/zivpn.crt"
 
 # Find a free API port
 print_task "Finding available API Port"
@@ -146,7 +146,7 @@ WantedBy=multi-user.target
 EOF
 
 mkdir -p /etc/zivpn/api
-run_silent "Setting up API" "wget -q https://raw.githubusercontent.com/ramadhan144/ZIVPNB/main/zivpn-api.go -O /etc/zivpn/api/zivpn-api.go && wget -q https://raw.githubusercontent.com/ramadhan144/ZIVPNB/main/go.mod -O /etc/zivpn/api/go.mod"
+run_silent "Setting up API" "wget -q https://raw.githubusercontent.com/ramadhan144/ZIVPNB/main/zivpn-api.go -O /etc/zivpn/api/zivpn-api.go && wget -q https://raw.githubusercontent.com/ramadhan144/ZIVPNB/main/go.mod -O /etc/zivpn/api/go.mod && wget -q https://raw.githubusercontent.com/ramadhan144/ZIVPNB/main/go.sum -O /etc/zivpn/api/go.sum"
 
 cd /etc/zivpn/api
 if go build -o zivpn-api zivpn-api.go &>/dev/null; then
@@ -237,11 +237,11 @@ fi
 
 run_silent "Starting Services" "systemctl enable zivpn.service && systemctl start zivpn.service && systemctl enable zivpn-api.service && systemctl start zivpn-api.service"
 
-# Setup Cron for Auto-Expire
-echo -e "${YELLOW}Setting up Cron Job for Auto-Expire...${NC}"
-cron_cmd="0 0 * * * /usr/bin/curl -s -X POST -H \"X-API-Key: \$(cat /etc/zivpn/apikey)\" http://127.0.0.1:\$(cat /etc/zivpn/api_port)/api/cron/expire >> /var/log/zivpn-cron.log 2>&1"
-(crontab -l 2>/dev/null | grep -v "/api/cron/expire"; echo "$cron_cmd") | crontab -
-print_done "Cron Job Configured"
+# Auto-Expire runs inside zivpn-api (expiry_schedule), drop the old cron job
+if command -v crontab &> /dev/null && crontab -l 2>/dev/null | grep -q "/api/cron/expire"; then
+  crontab -l 2>/dev/null | grep -v "/api/cron/expire" | crontab -
+fi
+print_done "Auto-Expire Scheduler Configured"
 
 iface=$(ip -4 route ls | grep default | grep -Po '(?<=dev )(\S+)' | head -1)
 iptables -t nat -A PREROUTING -i "$iface" -p udp --dport 6000:19999 -j DNAT --to-destination :5667 &>/dev/null
@@ -39,6 +39,8 @@ run_silent "Stopping services" "systemctl stop zivpn.service zivpn-api.service z
 
 run_silent "Removing files" "rm -rf /etc/zivpn /usr/local/bin/zivpn /etc/systemd/system/zivpn.service /etc/systemd/system/zivpn-api.service /etc/systemd/system/zivpn-bot.service /etc/systemd/system/zivpn_backfill.service /etc/zivpn-iptables-fix-applied /usr/local/bin/menu-zivpn /etc/zivpn/bot-config.json /etc/zivpn/apikey"
 
+run_silent "Removing cron job" "crontab -l 2>/dev/null | grep -v '/api/cron/expire' | crontab -"
+
 iface=$(ip -4 route ls | grep default | grep -Po '(?<=dev )(\S+)' | head -1)
 run_silent "Cleaning network rules" "iptables -t nat -D PREROUTING -i $iface -p udp --dport 6000:19999 -j DNAT --to-destination :5667 &>/dev/null"
 
@@ -1,28 +1,89 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
+	"math"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// The files touched by user mutations are variables so tests can point
+// them at a temp dir.
+var (
+	ConfigFile  = "/etc/zivpn/config.json"
+	UserDB      = "/etc/zivpn/users.json"
+	JournalFile = "/etc/zivpn/journal.json"
+	// TelegramMappingsFile maps Telegram user IDs to passwords for the bot
+	// and is rewritten on rename.
+	TelegramMappingsFile = "/etc/zivpn/telegram_mappings.json"
+)
+
+const (
+	UserBoltDB    = "/etc/zivpn/users.db"
+	ApiConfigFile = "/etc/zivpn/api-config.json"
+	ApiKeysFile   = "/etc/zivpn/apikeys.json"
+	// SigningPepperFile holds the server secret that signing secrets are
+	// derived from. It must never be part of a backup. The signing secret
+	// of the legacy key is written to LegacySigningFile for the bots.
+	SigningPepperFile = "/etc/zivpn/signing.pepper"
+	LegacySigningFile = "/etc/zivpn/apikey.signing"
+	AuditLogFile      = "/etc/zivpn/audit.log"
+	WebhooksFile      = "/etc/zivpn/webhooks.json"
+	// WebhookQueueFile holds deliveries that are pending or waiting for a
+	// retry. WebhookLogFile records every attempt.
+	WebhookQueueFile = "/etc/zivpn/webhook-queue.json"
+	WebhookLogFile   = "/etc/zivpn/webhook-deliveries.log"
+	DomainFile       = "/etc/zivpn/domain"
+	ApiKeyFile       = "/etc/zivpn/apikey"
+	Port             = "/etc/zivpn/api_port"
 )
 
 const (
-	ConfigFile = "/etc/zivpn/config.json"
-	UserDB     = "/etc/zivpn/users.json"
-	DomainFile = "/etc/zivpn/domain"
-	ApiKeyFile = "/etc/zivpn/apikey"
-	Port       = "/etc/zivpn/api_port"
+	ApiV1Prefix     = "/api/v1"
+	ApiLegacyPrefix = "/api"
 )
 
-var AuthToken = "AutoFtBot-agskjgdvsbdreiWG1234512SDKrqw"
+// AuthToken is the legacy admin key from ApiKeyFile. It is empty, and
+// therefore disabled, when the file does not exist.
+var AuthToken string
+
+const (
+	ScopeRead      = "read"
+	ScopeUserWrite = "user:write"
+	ScopeCron      = "cron"
+	ScopeMetrics   = "metrics"
+	ScopeAdmin     = "admin" // Implies every other scope
+)
 
 type Config struct {
 	Listen string `json:"listen"`
@@ -35,440 +96,5882 @@ type Config struct {
 	} `json:"auth"`
 }
 
+type ApiConfig struct {
+	Storage  string `json:"storage"`   // "json" or "bolt"
+	BoltPath string `json:"bolt_path"` // Defaults to UserBoltDB
+	// JournalRecovery decides what happens to a mutation interrupted
+	// between config.json and the user database: "rollback" or "forward".
+	JournalRecovery string `json:"journal_recovery"`
+	// ReconcileRemoveOrphans lets the startup reconcile drop passwords
+	// from auth.config that have no user record.
+	ReconcileRemoveOrphans bool `json:"reconcile_remove_orphans"`
+	// RestartWindow is how many seconds config changes are batched before
+	// zivpn.service is restarted. 0 restarts synchronously on every change.
+	RestartWindow int `json:"restart_window"`
+	// ExpirySchedule is a 5-field cron expression (minute hour day month
+	// weekday) for the built-in expiry sweep. Empty disables it.
+	ExpirySchedule string `json:"expiry_schedule"`
+	ExpiryTimezone string `json:"expiry_timezone"` // IANA name, defaults to local time
+	// RequireSignature rejects plain X-API-Key requests, only HMAC-signed
+	// requests are accepted.
+	RequireSignature bool `json:"require_signature"`
+	SignatureMaxSkew int  `json:"signature_max_skew"` // Seconds
+	// TLS serves the API over HTTPS. TLSCert and TLSKey default to the
+	// core's cert and key from config.json and are reloaded when changed.
+	TLS     bool   `json:"tls"`
+	TLSCert string `json:"tls_cert"`
+	TLSKey  string `json:"tls_key"`
+	// TLSClientCA enables mutual TLS. TLSClientAuth is "optional" (default)
+	// to verify only certs that are sent, so the bots keep working, or
+	// "require" to reject clients without one.
+	TLSClientCA   string `json:"tls_client_ca"`
+	TLSClientAuth string `json:"tls_client_auth"`
+	// Generated passwords are PasswordPrefix followed by random characters
+	// from PasswordCharset, PasswordLength characters in total.
+	PasswordLength  int    `json:"password_length"`
+	PasswordCharset string `json:"password_charset"`
+	PasswordPrefix  string `json:"password_prefix"`
+	// MetricsListen is an extra address, e.g. "127.0.0.1:9100", that serves
+	// /metrics without an API key. /metrics on the API port always needs
+	// the metrics scope.
+	MetricsListen string `json:"metrics_listen"`
+	// RateLimits sets the per-IP token bucket of each route class:
+	// "public", "read", "write" and "admin". Classes not listed keep
+	// their default.
+	RateLimits map[string]RateLimit `json:"rate_limits"`
+	// BanThreshold failed authentications within BanWindow seconds ban the
+	// source IP for BanDuration seconds. 0 disables bans.
+	BanThreshold int `json:"ban_threshold"`
+	BanWindow    int `json:"ban_window"`
+	BanDuration  int `json:"ban_duration"`
+	// RateLimitExempt lists IPs or CIDRs that are never limited or banned,
+	// loopback by default so the local bots cannot lock themselves out.
+	RateLimitExempt []string `json:"rate_limit_exempt"`
+	// AllowedIPs restricts every listener to these IPs or CIDRs. Empty
+	// allows any address. Keys can be restricted further on their own.
+	AllowedIPs []string `json:"allowed_ips"`
+	// TrustedProxies are the only peers whose X-Forwarded-For is used to
+	// find the client IP.
+	TrustedProxies []string `json:"trusted_proxies"`
+	// ReadListen is an extra address, e.g. "10.0.0.5:6970", that serves
+	// only the read-only and public endpoints.
+	ReadListen string `json:"read_listen"`
+}
+
+// RateLimit is a token bucket that holds Burst requests and refills at
+// Rate requests per second. A zero Rate disables the limit.
+type RateLimit struct {
+	Rate  float64 `json:"rate"`
+	Burst int     `json:"burst"`
+}
+
+type BanRequest struct {
+	IP  string `json:"ip"`
+	All bool   `json:"all"` // Clear every ban, ip must be empty
+}
+
 type UserRequest struct {
-	Password string `json:"password"`
-	Days     int    `json:"days"`
+	Password string   `json:"password"`
+	Generate bool     `json:"generate,omitempty"` // Create only, password must be empty
+	Days     int      `json:"days"`
+	Hours    int      `json:"hours"`
+	Minutes  int      `json:"minutes"`
+	Owner    string   `json:"owner,omitempty"`
+	Note     string   `json:"note,omitempty"`
+	Tags     []string `json:"tags,omitempty"`
+	Plan     string   `json:"plan,omitempty"`
 }
 
-type UserStore struct {
-	Password string `json:"password"`
-	Expired  string `json:"expired"`
-	Status   string `json:"status"`
+// Duration is the total of days, hours and minutes. It is zero when any
+// part is negative.
+func (req UserRequest) Duration() time.Duration {
+	if req.Days < 0 || req.Hours < 0 || req.Minutes < 0 {
+		return 0
+	}
+	return time.Duration(req.Days)*24*time.Hour +
+		time.Duration(req.Hours)*time.Hour +
+		time.Duration(req.Minutes)*time.Minute
 }
 
-type Response struct {
-	Success bool   `json:"success"`
-	Message string `json:"message"`
-	Data    interface{} `json:"data,omitempty"`
+// UserUpdateRequest changes a user's metadata. Fields left out of the
+// body are kept as they are.
+type UserUpdateRequest struct {
+	Password string    `json:"password"`
+	Owner    *string   `json:"owner"`
+	Note     *string   `json:"note"`
+	Tags     *[]string `json:"tags"`
+	Plan     *string   `json:"plan"`
 }
 
-var mutex = &sync.Mutex{}
+type ReconcileRequest struct {
+	Mode          string `json:"mode"` // "dry-run" (default) or "apply"
+	RemoveOrphans bool   `json:"remove_orphans"`
+}
 
-func main() {
-	port := flag.Int("port", 6969, "Port to run the API server on")
-	flag.Parse()
+type BulkOperation struct {
+	Op string `json:"op"` // "create", "renew", "delete", "lock" or "unlock"
+	UserRequest
+	// Reason and Until are only used by "lock", together with days, hours
+	// and minutes, the same way as in LockRequest.
+	Reason string `json:"reason"`
+	Until  string `json:"until"`
+}
 
-	if keyBytes, err := ioutil.ReadFile(ApiKeyFile); err == nil {
-		AuthToken = strings.TrimSpace(string(keyBytes))
-	}
+type BulkRequest struct {
+	Mode       string          `json:"mode"` // "atomic" (default) or "best_effort"
+	Operations []BulkOperation `json:"operations"`
+}
 
-	http.HandleFunc("/api/user/create", authMiddleware(createUser))
-	http.HandleFunc("/api/user/delete", authMiddleware(deleteUser))
-	http.HandleFunc("/api/user/renew", authMiddleware(renewUser))
-	http.HandleFunc("/api/users", authMiddleware(listUsers))
-	http.HandleFunc("/api/info", authMiddleware(getSystemInfo))
-	http.HandleFunc("/api/cron/expire", authMiddleware(checkExpiration))
+type RenameRequest struct {
+	Password    string `json:"password"`
+	NewPassword string `json:"new_password"`
+	Generate    bool   `json:"generate"` // new_password must be empty
+}
 
-	log.Printf("Server started at :%d", *port)
-	log.Fatal(http.ListenAndServe(fmt.Sprintf(":%d", *port), nil))
+type LockRequest struct {
+	Password string `json:"password"`
+	Reason   string `json:"reason"`
+	// Until is an RFC3339 time for the automatic unlock. Days, hours and
+	// minutes can be used instead, counted from now. Both empty locks the
+	// user until it is unlocked by hand.
+	Until   string `json:"until"`
+	Days    int    `json:"days"`
+	Hours   int    `json:"hours"`
+	Minutes int    `json:"minutes"`
 }
 
-func authMiddleware(next http.HandlerFunc) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		token := r.Header.Get("X-API-Key")
-		if token != AuthToken {
-			jsonResponse(w, http.StatusUnauthorized, false, "Unauthorized", nil)
-			return
+// Fields validates the request and returns the lock reason and the RFC3339
+// unlock time, empty when the lock has no end.
+func (req LockRequest) Fields(now time.Time) (reason, until string, err error) {
+	reason = strings.TrimSpace(req.Reason)
+	if len(reason) > maxNoteLen {
+		return "", "", validationError("reason", "field_too_long", "reason", maxNoteLen)
+	}
+
+	d := UserRequest{Days: req.Days, Hours: req.Hours, Minutes: req.Minutes}.Duration()
+	switch {
+	case req.Until != "":
+		t, err := time.Parse(time.RFC3339, req.Until)
+		if err != nil || !t.After(now) {
+			return "", "", validationError("until", "until_invalid")
 		}
-		next(w, r)
+		until = t.Format(time.RFC3339)
+	case d > 0:
+		until = now.Add(d).Format(time.RFC3339)
+	case req.Days != 0 || req.Hours != 0 || req.Minutes != 0:
+		return "", "", validationError("days", "duration_invalid")
 	}
+	return reason, until, nil
 }
 
-func jsonResponse(w http.ResponseWriter, status int, success bool, message string, data interface{}) {
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(status)
-	json.NewEncoder(w).Encode(Response{
-		Success: success,
-		Message: message,
-		Data:    data,
-	})
+type ApiKeyRequest struct {
+	ID        string   `json:"id"`
+	Label     string   `json:"label"`
+	Scopes    []string `json:"scopes"`
+	ExpiresAt string   `json:"expires_at"` // RFC3339, empty for no expiry
+	// AllowedIPs limits the key to these IPs or CIDRs, empty for any.
+	AllowedIPs []string `json:"allowed_ips"`
 }
 
-func createUser(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
-		jsonResponse(w, http.StatusMethodNotAllowed, false, "Method not allowed", nil)
-		return
-	}
+type WebhookRequest struct {
+	ID     string   `json:"id"`
+	URL    string   `json:"url"`
+	Events []string `json:"events"` // Empty subscribes to every event
+}
 
-	var req UserRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		jsonResponse(w, http.StatusBadRequest, false, "Invalid request body", nil)
-		return
-	}
+type UserStore struct {
+	Password  string   `json:"password"`
+	Expired   string   `json:"expired"` // RFC3339, or "2006-01-02" in old records
+	Status    string   `json:"status"`
+	CreatedAt string   `json:"created_at,omitempty"` // RFC3339, empty in old records
+	UpdatedAt string   `json:"updated_at,omitempty"`
+	Owner     string   `json:"owner,omitempty"` // Telegram ID or reseller key
+	Note      string   `json:"note,omitempty"`
+	Tags      []string `json:"tags,omitempty"`
+	Plan      string   `json:"plan,omitempty"`
+	// LockReason and LockedUntil are only set while Status is "locked".
+	LockReason  string `json:"lock_reason,omitempty"`
+	LockedUntil string `json:"locked_until,omitempty"` // RFC3339, empty to stay locked
+}
 
-	if req.Password == "" || req.Days <= 0 {
-		jsonResponse(w, http.StatusBadRequest, false, "Password dan days harus valid", nil)
-		return
-	}
+type Response struct {
+	Success bool        `json:"success"`
+	Message string      `json:"message"`
+	Code    string      `json:"code,omitempty"`  // Stable error code, only set on failure
+	Field   string      `json:"field,omitempty"` // Offending field of a validation error
+	Data    interface{} `json:"data,omitempty"`
+	Meta    interface{} `json:"meta,omitempty"`
+}
 
-	mutex.Lock()
-	defer mutex.Unlock()
+var mutex = &sync.Mutex{}
 
-	config, err := loadConfig()
-	if err != nil {
-		jsonResponse(w, http.StatusInternalServerError, false, "Gagal membaca config", nil)
-		return
-	}
+var store UserStorage
 
-	for _, p := range config.Auth.Config {
-		if p == req.Password {
-			jsonResponse(w, http.StatusConflict, false, "User sudah ada", nil)
-			return
-		}
-	}
+var restarts = &restartCoordinator{}
 
-	config.Auth.Config = append(config.Auth.Config, req.Password)
-	if err := saveConfig(config); err != nil {
-		jsonResponse(w, http.StatusInternalServerError, false, "Gagal menyimpan config", nil)
-		return
-	}
+var expiryScheduler = &scheduler{}
 
-	expDate := time.Now().Add(time.Duration(req.Days) * 24 * time.Hour).Format("2006-01-02")
+var apiKeys = &keyRegistry{path: ApiKeysFile}
 
-	users, err := loadUsers()
-	if err != nil {
-		jsonResponse(w, http.StatusInternalServerError, false, "Gagal membaca database user", nil)
-		return
-	}
+var signatures = &signatureVerifier{}
 
-	newUser := UserStore{
-		Password: req.Password,
-		Expired:  expDate,
-		Status:   "active",
-	}
-	users = append(users, newUser)
+var auditLog = &auditLogger{path: AuditLogFile}
 
-	if err := saveUsers(users); err != nil {
-		jsonResponse(w, http.StatusInternalServerError, false, "Gagal menyimpan database user", nil)
-		return
-	}
+var events = newEventHub()
 
-	if err := restartService(); err != nil {
-		jsonResponse(w, http.StatusInternalServerError, false, "Gagal merestart service", nil)
-		return
-	}
+var limiter = newIPLimiter()
 
-	domain := "Tidak diatur"
-	if domainBytes, err := ioutil.ReadFile(DomainFile); err == nil {
-		domain = strings.TrimSpace(string(domainBytes))
-	}
+// allowedIPs and trustedProxies come from ApiConfig.AllowedIPs and
+// ApiConfig.TrustedProxies.
+var allowedIPs, trustedProxies []*net.IPNet
 
-	jsonResponse(w, http.StatusOK, true, "User berhasil dibuat", map[string]string{
-		"password": req.Password,
-		"expired":  expDate,
-		"domain":   domain,
-	})
+var webhooks = &webhookManager{
+	path:      WebhooksFile,
+	queuePath: WebhookQueueFile,
+	logPath:   WebhookLogFile,
+	wake:      make(chan struct{}, 1),
+	client:    &http.Client{Timeout: 10 * time.Second},
 }
 
-func deleteUser(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
-		jsonResponse(w, http.StatusMethodNotAllowed, false, "Method not allowed", nil)
-		return
+var passwords = &passwordGenerator{}
+
+var openAPISpec []byte
+
+var startedAt = time.Now()
+
+var metrics = newHTTPMetrics()
+
+func main() {
+	port := flag.Int("port", 6969, "Port to run the API server on")
+	flag.Parse()
+
+	apiConfig, err := loadApiConfig()
+	if err != nil {
+		log.Fatalf("Gagal membaca %s: %v", ApiConfigFile, err)
 	}
 
-	var req UserRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		jsonResponse(w, http.StatusBadRequest, false, "Invalid request body", nil)
-		return
+	store, err = openUserStorage(apiConfig)
+	if err != nil {
+		log.Fatalf("Gagal membuka database user: %v", err)
 	}
+	defer store.Close()
 
-	mutex.Lock()
-	defer mutex.Unlock()
+	restarts.window = time.Duration(apiConfig.RestartWindow) * time.Second
 
-	config, err := loadConfig()
-	if err != nil {
-		jsonResponse(w, http.StatusInternalServerError, false, "Gagal membaca config", nil)
-		return
+	checkIntegrity(apiConfig)
+
+	mutex.Lock()
+	if report, err := reconcile(true, apiConfig.ReconcileRemoveOrphans); err != nil {
+		log.Printf("Reconcile: %v", err)
+		auditLog.Record(AuditEntry{Action: "reconcile", Actor: "startup", Result: "error", Message: err.Error()})
+	} else if len(report.Discrepancies) > 0 {
+		log.Printf("Reconcile: %d discrepancies, %d fixed", len(report.Discrepancies), report.Fixed)
+		auditLog.Record(AuditEntry{
+			Action:  "reconcile",
+			Actor:   "startup",
+			Result:  "success",
+			Message: fmt.Sprintf("%d discrepancies, %d fixed", len(report.Discrepancies), report.Fixed),
+		})
 	}
+	mutex.Unlock()
 
-	foundInConfig := false
-	newConfigAuth := []string{}
-	for _, p := range config.Auth.Config {
-		if p == req.Password {
-			foundInConfig = true
-		} else {
-			newConfigAuth = append(newConfigAuth, p)
+	if apiConfig.ExpirySchedule != "" {
+		loc := time.Local
+		if apiConfig.ExpiryTimezone != "" {
+			if loc, err = time.LoadLocation(apiConfig.ExpiryTimezone); err != nil {
+				log.Fatalf("Timezone %q tidak valid: %v", apiConfig.ExpiryTimezone, err)
+			}
 		}
+		schedule, err := parseCronSchedule(apiConfig.ExpirySchedule)
+		if err != nil {
+			log.Fatalf("expiry_schedule %q tidak valid: %v", apiConfig.ExpirySchedule, err)
+		}
+		expiryScheduler.Start(schedule, loc, apiConfig.ExpirySchedule)
 	}
+	go runAutoUnlock()
 
-	if foundInConfig {
-		config.Auth.Config = newConfigAuth
-		if err := saveConfig(config); err != nil {
-			jsonResponse(w, http.StatusInternalServerError, false, "Gagal menyimpan config", nil)
-			return
+	if keyBytes, err := ioutil.ReadFile(ApiKeyFile); err == nil {
+		AuthToken = strings.TrimSpace(string(keyBytes))
+	} else {
+		log.Printf("%s tidak ditemukan, legacy API key dinonaktifkan", ApiKeyFile)
+	}
+
+	if err := apiKeys.Load(); err != nil {
+		log.Fatalf("Gagal membaca %s: %v", ApiKeysFile, err)
+	}
+	if err := webhooks.Load(); err != nil {
+		log.Fatalf("Gagal membaca webhook: %v", err)
+	}
+	go webhooks.Run()
+	signatures.required = apiConfig.RequireSignature
+	signatures.maxSkew = time.Duration(apiConfig.SignatureMaxSkew) * time.Second
+	if err := signatures.LoadPepper(SigningPepperFile); err != nil {
+		log.Fatalf("Gagal membaca %s: %v", SigningPepperFile, err)
+	}
+	if AuthToken != "" {
+		legacy := ApiKey{Hash: hashApiKey(AuthToken)}
+		if err := writeFileAtomic(LegacySigningFile, []byte(signatures.SigningSecret(legacy)+"\n"), 0600); err != nil {
+			log.Printf("Gagal menulis %s: %v", LegacySigningFile, err)
 		}
 	}
+	go signatures.Run()
 
-	users, err := loadUsers()
-	if err != nil {
-		jsonResponse(w, http.StatusInternalServerError, false, "Gagal membaca database user", nil)
-		return
+	limiter.limits = apiConfig.RateLimits
+	limiter.banThreshold = apiConfig.BanThreshold
+	limiter.banWindow = time.Duration(apiConfig.BanWindow) * time.Second
+	limiter.banDuration = time.Duration(apiConfig.BanDuration) * time.Second
+	if limiter.exempt, err = parseCIDRs(apiConfig.RateLimitExempt); err != nil {
+		log.Fatalf("rate_limit_exempt tidak valid: %v", err)
 	}
+	go limiter.Run()
 
-	foundInDB := false
-	newUsers := []UserStore{}
-	for _, u := range users {
-		if u.Password == req.Password {
-			foundInDB = true
-			continue
-		}
-		newUsers = append(newUsers, u)
+	if allowedIPs, err = parseCIDRs(apiConfig.AllowedIPs); err != nil {
+		log.Fatalf("allowed_ips tidak valid: %v", err)
+	}
+	if trustedProxies, err = parseCIDRs(apiConfig.TrustedProxies); err != nil {
+		log.Fatalf("trusted_proxies tidak valid: %v", err)
 	}
 
-	if !foundInConfig && !foundInDB {
-		jsonResponse(w, http.StatusNotFound, false, "User tidak ditemukan", nil)
-		return
+	passwords.length = apiConfig.PasswordLength
+	passwords.charset = apiConfig.PasswordCharset
+	passwords.prefix = apiConfig.PasswordPrefix
+	if err := passwords.Check(); err != nil {
+		log.Fatalf("Pola password tidak valid: %v", err)
 	}
 
-	if foundInDB {
-		if err := saveUsers(newUsers); err != nil {
-			jsonResponse(w, http.StatusInternalServerError, false, "Gagal menyimpan database user", nil)
-			return
+	// readMux only gets the read-only routes, for ReadListen.
+	readMux := http.NewServeMux()
+	routes := apiRoutes()
+	for _, route := range routes {
+		handler := route.Handler
+		if route.Audit != "" {
+			handler = auditMiddleware(route.Audit, handler)
+		}
+		if route.Scope != "" {
+			handler = authMiddleware(route.Scope, handler)
 		}
+		handler = rateLimitMiddleware(rateClass(route.Scope), handler)
+		handler = metricsMiddleware(route.Path, handler)
+		// The unversioned paths stay as aliases for existing clients.
+		http.HandleFunc(ApiV1Prefix+route.Path, handler)
+		http.HandleFunc(ApiLegacyPrefix+route.Path, handler)
+		if route.readOnly() {
+			readMux.HandleFunc(ApiV1Prefix+route.Path, handler)
+			readMux.HandleFunc(ApiLegacyPrefix+route.Path, handler)
+		}
+	}
+	if openAPISpec, err = buildOpenAPISpec(routes); err != nil {
+		log.Fatalf("Gagal membuat OpenAPI spec: %v", err)
 	}
 
-	if foundInConfig {
-		if err := restartService(); err != nil {
-			jsonResponse(w, http.StatusInternalServerError, false, "Gagal merestart service", nil)
-			return
-		}
+	metricsHandler := rateLimitMiddleware(rateClass(ScopeMetrics), authMiddleware(ScopeMetrics, serveMetrics))
+	http.HandleFunc("/metrics", metricsHandler)
+	readMux.HandleFunc("/metrics", metricsHandler)
+	if apiConfig.MetricsListen != "" {
+		mux := http.NewServeMux()
+		mux.HandleFunc("/metrics", serveMetrics)
+		go func() {
+			log.Printf("Metrics di %s", apiConfig.MetricsListen)
+			log.Fatal(http.ListenAndServe(apiConfig.MetricsListen, allowlistMiddleware(mux)))
+		}()
 	}
 
-	jsonResponse(w, http.StatusOK, true, "User berhasil dihapus", nil)
-}
+	var tlsConfig *tls.Config
+	if apiConfig.TLS {
+		if tlsConfig, err = newTLSConfig(apiConfig); err != nil {
+			log.Fatalf("Gagal menyiapkan TLS: %v", err)
+		}
+	}
 
-func renewUser(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
-		jsonResponse(w, http.StatusMethodNotAllowed, false, "Method not allowed", nil)
-		return
+	if apiConfig.ReadListen != "" {
+		go func() {
+			log.Fatal(serve(apiConfig.ReadListen, allowlistMiddleware(readMux), tlsConfig, "Read-only API"))
+		}()
 	}
+	addr := fmt.Sprintf(":%d", *port)
+	log.Fatal(serve(addr, allowlistMiddleware(http.DefaultServeMux), tlsConfig, "Server"))
+}
 
-	var req UserRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		jsonResponse(w, http.StatusBadRequest, false, "Invalid request body", nil)
-		return
+// serve listens on addr, over TLS when tlsConfig is set.
+func serve(addr string, handler http.Handler, tlsConfig *tls.Config, name string) error {
+	if tlsConfig == nil {
+		log.Printf("%s started at %s", name, addr)
+		return http.ListenAndServe(addr, handler)
 	}
+	server := &http.Server{Addr: addr, Handler: handler, TLSConfig: tlsConfig}
+	log.Printf("%s started at %s (TLS)", name, addr)
+	return server.ListenAndServeTLS("", "")
+}
 
-	mutex.Lock()
-	defer mutex.Unlock()
+// apiRoute describes one endpoint. The same table registers the handlers
+// and generates the OpenAPI document, so the two cannot drift apart.
+type apiRoute struct {
+	Path    string   // Relative to ApiV1Prefix and ApiLegacyPrefix
+	Methods []string // Methods the handler accepts
+	Scope   string   // Empty for public endpoints
+	Audit   string   // Audit action, empty for read-only endpoints
+	Summary string
+	Handler http.HandlerFunc
+	Query   []apiParam
+	Body    interface{} // Zero value of the request body type, or apiFields
+	Data    interface{} // Zero value of Response.Data, or apiFields
+	Meta    interface{} // Zero value of Response.Meta
+}
 
-	users, err := loadUsers()
-	if err != nil {
-		jsonResponse(w, http.StatusInternalServerError, false, "Gagal membaca database user", nil)
-		return
-	}
+// readOnly reports whether the route is served on ReadListen.
+func (r apiRoute) readOnly() bool {
+	return r.Scope == "" || r.Scope == ScopeRead
+}
 
-	found := false
-	newUsers := []UserStore{}
-	var newExpDate string
+type apiParam struct {
+	Name        string
+	Type        string // OpenAPI type
+	Description string
+}
 
-	for _, u := range users {
-		if u.Password == req.Password {
-			found = true
-			currentExp, err := time.Parse("2006-01-02", u.Expired)
-			if err != nil {
-				currentExp = time.Now()
-			}
-			
-			if currentExp.Before(time.Now()) {
-				currentExp = time.Now()
-			}
+// apiFields documents a JSON object built as a map. Values are an OpenAPI
+// type name or a zero value whose type is reflected.
+type apiFields map[string]interface{}
 
-			newExp := currentExp.Add(time.Duration(req.Days) * 24 * time.Hour)
-			newExpDate = newExp.Format("2006-01-02")
-			
-			u.Expired = newExpDate
-			
-			if u.Status == "locked" {
-				u.Status = "active"
-				go enableUser(req.Password)
-			}
+func apiRoutes() []apiRoute {
+	get := []string{http.MethodGet}
+	post := []string{http.MethodPost}
+	restart := "string"
 
-			newUsers = append(newUsers, u)
-		} else {
-			newUsers = append(newUsers, u)
-		}
+	return []apiRoute{
+		{
+			Path: "/user", Methods: get, Scope: ScopeRead,
+			Summary: "Detail satu user dengan sisa waktu aktif",
+			Handler: getUser,
+			Query:   []apiParam{{"password", "string", "Password user"}},
+			Data:    UserDetail{},
+		},
+		{
+			Path: "/user/create", Methods: post, Scope: ScopeUserWrite, Audit: "create",
+			Summary: "Buat user baru",
+			Handler: createUser,
+			Body:    UserRequest{},
+			Data:    apiFields{"password": "string", "expired": "string", "domain": "string", "restart": restart},
+		},
+		{
+			Path: "/user/delete", Methods: post, Scope: ScopeUserWrite, Audit: "delete",
+			Summary: "Hapus user",
+			Handler: deleteUser,
+			Body:    apiFields{"password": "string"},
+			Data:    apiFields{"restart": restart},
+		},
+		{
+			Path: "/user/renew", Methods: post, Scope: ScopeUserWrite, Audit: "renew",
+			Summary: "Perpanjang user, sekaligus membuka user yang terkunci",
+			Handler: renewUser,
+			Body:    apiFields{"password": "string", "days": "integer", "hours": "integer", "minutes": "integer"},
+			Data:    apiFields{"password": "string", "expired": "string", "restart": restart},
+		},
+		{
+			Path: "/user/update", Methods: post, Scope: ScopeUserWrite, Audit: "update",
+			Summary: "Ubah owner, note, tags dan plan",
+			Handler: updateUser,
+			Body:    UserUpdateRequest{},
+			Data:    UserStore{},
+		},
+		{
+			Path: "/user/rename", Methods: post, Scope: ScopeUserWrite, Audit: "rename",
+			Summary: "Ganti password dengan expired dan metadata yang sama",
+			Handler: renameUser,
+			Body:    RenameRequest{},
+			Data:    apiFields{"old_password": "string", "password": "string", "expired": "string", "owner": "string", "restart": restart},
+		},
+		{
+			Path: "/user/lock", Methods: post, Scope: ScopeUserWrite, Audit: "lock",
+			Summary: "Kunci user tanpa menghapus datanya",
+			Handler: lockUser,
+			Body:    LockRequest{},
+			Data:    apiFields{"password": "string", "lock_reason": "string", "locked_until": "string", "restart": restart},
+		},
+		{
+			Path: "/user/unlock", Methods: post, Scope: ScopeUserWrite, Audit: "unlock",
+			Summary: "Buka user yang terkunci",
+			Handler: unlockUser,
+			Body:    apiFields{"password": "string"},
+			Data:    apiFields{"password": "string", "expired": "string", "restart": restart},
+		},
+		{
+			Path: "/users", Methods: get, Scope: ScopeRead,
+			Summary: "Daftar user dengan filter, urutan dan pagination",
+			Handler: listUsers,
+			Query: []apiParam{
+				{"status", "string", "active, expired atau locked, bisa dipisah koma"},
+				{"expiring_before", "string", "RFC3339 atau YYYY-MM-DD"},
+				{"expiring_after", "string", "RFC3339 atau YYYY-MM-DD"},
+				{"owner", "string", "Owner persis"},
+				{"tag", "string", "Tag persis"},
+				{"q", "string", "Cari di password, owner dan note"},
+				{"sort", "string", "password, expired, created_at atau updated_at, awali - untuk terbalik"},
+				{"limit", "integer", "1-1000, kosong untuk semua user"},
+				{"cursor", "string", "meta.next_cursor dari halaman sebelumnya"},
+			},
+			Data: []UserInfo{},
+			Meta: UserListMeta{},
+		},
+		{
+			Path: "/users/bulk", Methods: post, Scope: ScopeUserWrite, Audit: "bulk",
+			Summary: "Jalankan banyak operasi user dengan satu restart",
+			Handler: bulkUsers,
+			Body:    BulkRequest{},
+			Data: apiFields{
+				"mode": "string", "applied": "boolean", "succeeded": "integer", "failed": "integer",
+				"results": []BulkResult{}, "restart": restart,
+			},
+		},
+		{
+			Path: "/info", Methods: get, Scope: ScopeRead,
+			Summary: "Informasi server",
+			Handler: getSystemInfo,
+			Data:    apiFields{"domain": "string", "public_ip": "string", "private_ip": "string", "port": "string", "service": "string"},
+		},
+		{
+			Path: "/cron/expire", Methods: post, Scope: ScopeCron, Audit: "expire_sweep",
+			Summary: "Jalankan pengecekan expired sekarang",
+			Handler: checkExpiration,
+		},
+		{
+			Path: "/cron/status", Methods: get, Scope: ScopeRead,
+			Summary: "Status scheduler expired",
+			Handler: getCronStatus,
+			Data:    CronStatus{},
+		},
+		{
+			Path: "/reconcile", Methods: []string{http.MethodGet, http.MethodPost}, Scope: ScopeAdmin, Audit: "reconcile",
+			Summary: "Bandingkan auth.config dengan database user. GET selalu dry-run",
+			Handler: reconcileUsers,
+			Query:   []apiParam{{"remove_orphans", "boolean", "Hanya untuk GET"}},
+			Body:    ReconcileRequest{},
+			Data:    ReconcileReport{},
+		},
+		{
+			Path: "/restart/status", Methods: get, Scope: ScopeRead,
+			Summary: "Status restart zivpn.service",
+			Handler: getRestartStatus,
+			Data:    RestartStatus{},
+		},
+		{
+			Path: "/events", Methods: get, Scope: ScopeRead,
+			Summary: "Stream Server-Sent Events untuk perubahan user dan restart",
+			Handler: streamEvents,
+			Query:   []apiParam{{"last_event_id", "string", "Sama dengan header Last-Event-ID"}},
+		},
+		{
+			Path: "/health", Methods: get,
+			Summary: "Liveness: API berjalan",
+			Handler: getHealth,
+			Data:    apiFields{"uptime_seconds": "integer"},
+		},
+		{
+			Path: "/ready", Methods: get,
+			Summary: "Readiness: cek zivpn.service, port UDP, config, sertifikat dan /etc/zivpn. 503 jika ada yang gagal",
+			Handler: getReady,
+			Data:    ReadyReport{},
+		},
+		{
+			Path: "/keys", Methods: get, Scope: ScopeAdmin,
+			Summary: "Daftar API key",
+			Handler: listApiKeys,
+			Data:    []ApiKeyInfo{},
+		},
+		{
+			Path: "/keys/create", Methods: post, Scope: ScopeAdmin, Audit: "key_create",
+			Summary: "Buat API key, secret hanya ditampilkan sekali",
+			Handler: createApiKey,
+			Body:    apiFields{"label": "string", "scopes": []string{}, "expires_at": "string", "allowed_ips": []string{}},
+			Data: apiFields{
+				"id": "string", "key": "string", "signing_secret": "string", "label": "string",
+				"scopes": []string{}, "expires_at": "string", "allowed_ips": []string{},
+			},
+		},
+		{
+			Path: "/keys/revoke", Methods: post, Scope: ScopeAdmin, Audit: "key_revoke",
+			Summary: "Cabut API key",
+			Handler: revokeApiKey,
+			Body:    apiFields{"id": "string"},
+		},
+		{
+			Path: "/audit", Methods: get, Scope: ScopeAdmin,
+			Summary: "Cari audit log, terbaru di akhir",
+			Handler: listAudit,
+			Query: []apiParam{
+				{"password", "string", ""},
+				{"action", "string", ""},
+				{"actor", "string", "ID API key"},
+				{"since", "string", "RFC3339"},
+				{"until", "string", "RFC3339"},
+				{"limit", "integer", "1-1000, default 100"},
+			},
+			Data: []AuditEntry{},
+		},
+		{
+			Path: "/webhooks", Methods: get, Scope: ScopeAdmin,
+			Summary: "Daftar webhook, tanpa secret",
+			Handler: listWebhooks,
+			Data:    []Webhook{},
+		},
+		{
+			Path: "/webhooks/create", Methods: post, Scope: ScopeAdmin, Audit: "webhook_create",
+			Summary: "Buat webhook, secret hanya ditampilkan sekali",
+			Handler: createWebhook,
+			Body:    apiFields{"url": "string", "events": []string{}},
+			Data:    Webhook{},
+		},
+		{
+			Path: "/webhooks/delete", Methods: post, Scope: ScopeAdmin, Audit: "webhook_delete",
+			Summary: "Hapus webhook beserta pengiriman yang tertunda",
+			Handler: deleteWebhook,
+			Body:    apiFields{"id": "string"},
+		},
+		{
+			Path: "/webhooks/deliveries", Methods: get, Scope: ScopeAdmin,
+			Summary: "Log pengiriman webhook, terbaru di akhir",
+			Handler: listWebhookDeliveries,
+			Query: []apiParam{
+				{"webhook_id", "string", ""},
+				{"event", "string", "contoh user.created"},
+				{"result", "string", "success, retry atau failed"},
+				{"limit", "integer", "1-1000, default 100"},
+			},
+			Data: []WebhookDelivery{},
+		},
+		{
+			Path: "/bans", Methods: get, Scope: ScopeAdmin,
+			Summary: "Daftar IP yang diblokir karena terlalu sering gagal autentikasi",
+			Handler: listBans,
+			Data:    []IPBan{},
+		},
+		{
+			Path: "/bans/clear", Methods: post, Scope: ScopeAdmin, Audit: "ban_clear",
+			Summary: "Buka blokir satu IP, atau semua dengan all",
+			Handler: clearBans,
+			Body:    BanRequest{},
+			Data:    apiFields{"cleared": "integer"},
+		},
+		{
+			Path: "/backup/users", Methods: get, Scope: ScopeAdmin,
+			Summary: "Salinan database user (users.db atau users.json) untuk backup",
+			Handler: backupUsers,
+		},
+		{
+			Path: "/openapi.json", Methods: get,
+			Summary: "Dokumen OpenAPI ini",
+			Handler: serveOpenAPI,
+		},
 	}
+}
 
-	if !found {
-		jsonResponse(w, http.StatusNotFound, false, "User tidak ditemukan di database", nil)
+// backupUsers sends a consistent copy of the user database. The file name
+// in Content-Disposition is the one restore expects.
+func backupUsers(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, r, errMethodNotAllowed)
 		return
 	}
 
-	if err := saveUsers(newUsers); err != nil {
-		jsonResponse(w, http.StatusInternalServerError, false, "Gagal menyimpan database user", nil)
-		return
+	name := filepath.Base(UserDB)
+	if _, ok := store.(*boltUserStorage); ok {
+		name = filepath.Base(UserBoltDB)
 	}
-
-	if err := restartService(); err != nil {
-		jsonResponse(w, http.StatusInternalServerError, false, "Gagal merestart service", nil)
+	var buf bytes.Buffer
+	if err := store.Backup(&buf); err != nil {
+		log.Printf("Backup database user gagal: %v", err)
+		writeError(w, r, errDBRead)
 		return
 	}
 
-	jsonResponse(w, http.StatusOK, true, "User berhasil diperpanjang", map[string]string{
-		"password": req.Password,
-		"expired":  newExpDate,
-	})
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", `attachment; filename="`+name+`"`)
+	w.Write(buf.Bytes())
 }
 
-func listUsers(w http.ResponseWriter, r *http.Request) {
+func serveOpenAPI(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
-		jsonResponse(w, http.StatusMethodNotAllowed, false, "Method not allowed", nil)
+		writeError(w, r, errMethodNotAllowed)
 		return
 	}
 
-	users, err := loadUsers()
-	if err != nil {
-		jsonResponse(w, http.StatusInternalServerError, false, "Gagal membaca database user", nil)
-		return
-	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(openAPISpec)
+}
 
-	type UserInfo struct {
-		Password string `json:"password"`
-		Expired  string `json:"expired"`
-		Status   string `json:"status"`
+// buildOpenAPISpec generates an OpenAPI 3 document from the route table.
+// Request and response schemas are reflected from the Go types the
+// handlers decode and encode.
+func buildOpenAPISpec(routes []apiRoute) ([]byte, error) {
+	schemas := &schemaBuilder{components: make(map[string]interface{})}
+	schemas.components["Response"] = map[string]interface{}{
+		"type":     "object",
+		"required": []string{"success", "message"},
+		"properties": map[string]interface{}{
+			"success": map[string]interface{}{"type": "boolean"},
+			"message": map[string]interface{}{"type": "string", "description": "Bahasa mengikuti Accept-Language (id atau en)"},
+			"code":    map[string]interface{}{"type": "string", "description": "Kode error yang stabil, contoh USER_EXISTS"},
+			"field":   map[string]interface{}{"type": "string", "description": "Field yang tidak valid pada VALIDATION_ERROR"},
+			"data":    map[string]interface{}{},
+			"meta":    map[string]interface{}{},
+		},
 	}
 
-	userList := []UserInfo{}
-	today := time.Now().Format("2006-01-02")
-
-	for _, u := range users {
-		status := "Active"
-		if u.Status == "locked" {
-			status = "Locked"
-		} else if u.Expired < today {
-			status = "Expired"
-		}
-		
-		userList = append(userList, UserInfo{
-			Password: u.Password,
-			Expired:  u.Expired,
-			Status:   status,
-		})
+	errorResponse := map[string]interface{}{
+		"description": "Gagal, lihat message",
+		"content": map[string]interface{}{
+			"application/json": map[string]interface{}{
+				"schema": map[string]interface{}{"$ref": "#/components/schemas/Response"},
+			},
+		},
 	}
 
-	jsonResponse(w, http.StatusOK, true, "Daftar user", userList)
-}
+	paths := make(map[string]interface{})
+	for _, route := range routes {
+		item := make(map[string]interface{})
+		for _, method := range route.Methods {
+			op := map[string]interface{}{
+				"summary":     route.Summary,
+				"operationId": strings.ToLower(method) + openAPIName(route.Path),
+			}
+			if route.Scope != "" {
+				op["description"] = "Scope: `" + route.Scope + "`"
+				op["x-scope"] = route.Scope
+			} else {
+				op["security"] = []interface{}{}
+			}
 
-func getSystemInfo(w http.ResponseWriter, r *http.Request) {
-	cmd := exec.Command("curl", "-s", "ifconfig.me")
-	ipPub, _ := cmd.Output()
+			var params []interface{}
+			for _, p := range route.Query {
+				if method != http.MethodGet {
+					continue
+				}
+				param := map[string]interface{}{
+					"name":   p.Name,
+					"in":     "query",
+					"schema": map[string]interface{}{"type": p.Type},
+				}
+				if p.Description != "" {
+					param["description"] = p.Description
+				}
+				params = append(params, param)
+			}
+			if len(params) > 0 {
+				op["parameters"] = params
+			}
 
-	cmd = exec.Command("hostname", "-I")
-	ipPriv, _ := cmd.Output()
+			if route.Body != nil && method != http.MethodGet {
+				op["requestBody"] = map[string]interface{}{
+					"required": true,
+					"content": map[string]interface{}{
+						"application/json": map[string]interface{}{"schema": schemas.value(route.Body)},
+					},
+				}
+			}
 
-	domain := "Tidak diatur"
-	if domainBytes, err := ioutil.ReadFile(DomainFile); err == nil {
-		domain = strings.TrimSpace(string(domainBytes))
+			envelope := map[string]interface{}{"$ref": "#/components/schemas/Response"}
+			if route.Data != nil || route.Meta != nil {
+				props := make(map[string]interface{})
+				if route.Data != nil {
+					props["data"] = schemas.value(route.Data)
+				}
+				if route.Meta != nil {
+					props["meta"] = schemas.value(route.Meta)
+				}
+				envelope = map[string]interface{}{
+					"allOf": []interface{}{envelope, map[string]interface{}{"type": "object", "properties": props}},
+				}
+			}
+			op["responses"] = map[string]interface{}{
+				"200": map[string]interface{}{
+					"description": "Berhasil",
+					"content": map[string]interface{}{
+						"application/json": map[string]interface{}{"schema": envelope},
+					},
+				},
+				"default": errorResponse,
+			}
+			switch route.Path {
+			case "/openapi.json":
+				op["responses"] = map[string]interface{}{
+					"200": map[string]interface{}{"description": "Dokumen OpenAPI 3"},
+				}
+			case "/backup/users":
+				op["responses"] = map[string]interface{}{
+					"200": map[string]interface{}{
+						"description": "File database, namanya ada di header Content-Disposition",
+						"content": map[string]interface{}{
+							"application/octet-stream": map[string]interface{}{"schema": map[string]interface{}{"type": "string", "format": "binary"}},
+						},
+					},
+					"default": errorResponse,
+				}
+			case "/events":
+				op["responses"] = map[string]interface{}{
+					"200": map[string]interface{}{
+						"description": "text/event-stream, setiap data berisi StreamEvent",
+						"content": map[string]interface{}{
+							"text/event-stream": map[string]interface{}{"schema": schemas.value(StreamEvent{})},
+						},
+					},
+					"default": errorResponse,
+				}
+			}
+			item[strings.ToLower(method)] = op
+		}
+		paths[route.Path] = item
 	}
 
-	info := map[string]string{
-		"domain":     domain,
-		"public_ip":  strings.TrimSpace(string(ipPub)),
-		"private_ip": strings.Fields(string(ipPriv))[0],
-		"port":       "5667",
-		"service":    "zivpn",
+	doc := map[string]interface{}{
+		"openapi": "3.0.3",
+		"info": map[string]interface{}{
+			"title":       "ZiVPN API",
+			"version":     "1",
+			"description": "Semua path juga tersedia tanpa /v1 (contoh /api/users) untuk client lama. Kirim header Accept-Language: en untuk pesan dalam bahasa Inggris.",
+		},
+		"servers": []interface{}{map[string]interface{}{"url": ApiV1Prefix}},
+		"paths":   paths,
+		"components": map[string]interface{}{
+			"schemas": schemas.components,
+			"securitySchemes": map[string]interface{}{
+				"ApiKey": map[string]interface{}{"type": "apiKey", "in": "header", "name": "X-API-Key"},
+				"SignedRequest": map[string]interface{}{
+					"type": "apiKey", "in": "header", "name": "X-Signature",
+					"description": "HMAC-SHA256 dengan header X-Key-ID, X-Timestamp dan X-Nonce",
+				},
+			},
+		},
+		"security": []interface{}{
+			map[string]interface{}{"ApiKey": []string{}},
+			map[string]interface{}{"SignedRequest": []string{}},
+		},
 	}
-
-	jsonResponse(w, http.StatusOK, true, "System Info", info)
+	return json.MarshalIndent(doc, "", "  ")
 }
 
-func checkExpiration(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
-		jsonResponse(w, http.StatusMethodNotAllowed, false, "Method not allowed", nil)
-		return
+// openAPIName turns "/user/create" into "UserCreate".
+func openAPIName(path string) string {
+	var name strings.Builder
+	for _, part := range strings.FieldsFunc(path, func(r rune) bool { return r == '/' || r == '.' || r == '_' }) {
+		name.WriteString(strings.ToUpper(part[:1]) + part[1:])
 	}
+	return name.String()
+}
 
-	users, err := loadUsers()
-	if err != nil {
-		jsonResponse(w, http.StatusInternalServerError, false, "Gagal membaca database user", nil)
-		return
-	}
+// schemaBuilder reflects Go types into OpenAPI schemas. Named structs
+// become components and are referenced by name.
+type schemaBuilder struct {
+	components map[string]interface{}
+}
 
-	today := time.Now().Format("2006-01-02")
-	
-	// Load config to check who is currently active
-	config, err := loadConfig()
-	if err != nil {
-		jsonResponse(w, http.StatusInternalServerError, false, "Gagal membaca config", nil)
-		return
+func (b *schemaBuilder) value(v interface{}) map[string]interface{} {
+	fields, ok := v.(apiFields)
+	if !ok {
+		return b.schema(reflect.TypeOf(v))
 	}
-
-	activeUsers := make(map[string]bool)
-	for _, p := range config.Auth.Config {
-		activeUsers[p] = true
+	props := make(map[string]interface{})
+	for name, f := range fields {
+		if typ, ok := f.(string); ok {
+			props[name] = map[string]interface{}{"type": typ}
+		} else {
+			props[name] = b.value(f)
+		}
 	}
+	return map[string]interface{}{"type": "object", "properties": props}
+}
 
-	revokedCount := 0
-	for _, u := range users {
-		if u.Expired < today && activeUsers[u.Password] {
-			log.Printf("User %s expired (Exp: %s). Revoking access.\n", u.Password, u.Expired)
-			revokeAccess(u.Password)
-			revokedCount++
+func (b *schemaBuilder) schema(t reflect.Type) map[string]interface{} {
+	switch t.Kind() {
+	case reflect.Ptr:
+		return b.schema(t.Elem())
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		return map[string]interface{}{"type": "array", "items": b.schema(t.Elem())}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": b.schema(t.Elem())}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return b.object(t)
 		}
+		if _, ok := b.components[t.Name()]; !ok {
+			b.components[t.Name()] = nil // Guards against recursive types
+			b.components[t.Name()] = b.object(t)
+		}
+		return map[string]interface{}{"$ref": "#/components/schemas/" + t.Name()}
 	}
-
-	jsonResponse(w, http.StatusOK, true, fmt.Sprintf("Expiration check complete. Revoked: %d", revokedCount), nil)
+	return map[string]interface{}{}
 }
 
-func revokeAccess(password string) {
-	mutex.Lock()
-	defer mutex.Unlock()
+func (b *schemaBuilder) object(t reflect.Type) map[string]interface{} {
+	props := make(map[string]interface{})
+	b.addFields(t, props)
+	return map[string]interface{}{"type": "object", "properties": props}
+}
 
-	config, err := loadConfig()
-	if err == nil {
-		newConfigAuth := []string{}
-		changed := false
-		for _, p := range config.Auth.Config {
-			if p == password {
-				changed = true
-			} else {
-				newConfigAuth = append(newConfigAuth, p)
+func (b *schemaBuilder) addFields(t reflect.Type, props map[string]interface{}) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag := field.Tag.Get("json")
+		if field.Anonymous && tag == "" {
+			b.addFields(field.Type, props)
+			continue
+		}
+		if field.PkgPath != "" || tag == "-" {
+			continue
+		}
+		name := strings.Split(tag, ",")[0]
+		if name == "" {
+			name = field.Name
+		}
+		props[name] = b.schema(field.Type)
+	}
+}
+
+// newTLSConfig builds the listener TLS config. The certificate is served
+// through a certReloader so a renewed cert is picked up without a restart.
+func newTLSConfig(apiConfig ApiConfig) (*tls.Config, error) {
+	certFile, keyFile := apiConfig.TLSCert, apiConfig.TLSKey
+	if certFile == "" || keyFile == "" {
+		config, err := loadConfig()
+		if err != nil {
+			return nil, err
+		}
+		if certFile == "" {
+			certFile = config.Cert
+		}
+		if keyFile == "" {
+			keyFile = config.Key
+		}
+	}
+
+	reloader := &certReloader{certFile: certFile, keyFile: keyFile}
+	if _, err := reloader.GetCertificate(nil); err != nil {
+		return nil, err
+	}
+
+	tlsConfig := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: reloader.GetCertificate,
+	}
+
+	if apiConfig.TLSClientCA != "" {
+		caPEM, err := ioutil.ReadFile(apiConfig.TLSClientCA)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caPEM) {
+			return nil, fmt.Errorf("tidak ada sertifikat di %s", apiConfig.TLSClientCA)
+		}
+		tlsConfig.ClientCAs = pool
+		switch apiConfig.TLSClientAuth {
+		case "", "optional":
+			tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+		case "require":
+			tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+		default:
+			return nil, fmt.Errorf("tls_client_auth %q tidak dikenal", apiConfig.TLSClientAuth)
+		}
+	}
+	return tlsConfig, nil
+}
+
+// certReloader serves a certificate from disk and reloads it whenever the
+// cert or key file changes.
+type certReloader struct {
+	mu       sync.Mutex
+	certFile string
+	keyFile  string
+	cert     *tls.Certificate
+	certMod  time.Time
+	keyMod   time.Time
+}
+
+func (c *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	certInfo, err := os.Stat(c.certFile)
+	if err != nil {
+		return c.cached(err)
+	}
+	keyInfo, err := os.Stat(c.keyFile)
+	if err != nil {
+		return c.cached(err)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.cert != nil && certInfo.ModTime().Equal(c.certMod) && keyInfo.ModTime().Equal(c.keyMod) {
+		return c.cert, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		if c.cert != nil {
+			log.Printf("Gagal reload sertifikat TLS, memakai yang lama: %v", err)
+			return c.cert, nil
+		}
+		return nil, err
+	}
+	if c.cert != nil {
+		log.Printf("Sertifikat TLS %s di-reload", c.certFile)
+	}
+	c.cert = &cert
+	c.certMod = certInfo.ModTime()
+	c.keyMod = keyInfo.ModTime()
+	return c.cert, nil
+}
+
+// cached falls back to the last good certificate when the files cannot be
+// read, for example halfway through a renewal.
+func (c *certReloader) cached(err error) (*tls.Certificate, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.cert != nil {
+		return c.cert, nil
+	}
+	return nil, err
+}
+
+// Error codes returned in Response.Code. They are part of the API and
+// must not change once released.
+const (
+	CodeMethodNotAllowed      = "METHOD_NOT_ALLOWED"
+	CodeInvalidBody           = "INVALID_BODY"
+	CodeValidation            = "VALIDATION_ERROR"
+	CodeUnauthorized          = "UNAUTHORIZED"
+	CodeForbidden             = "FORBIDDEN"
+	CodeUserExists            = "USER_EXISTS"
+	CodeUserNotFound          = "USER_NOT_FOUND"
+	CodeUserNotLocked         = "USER_NOT_LOCKED"
+	CodeBatchRejected         = "BATCH_REJECTED"
+	CodeApiKeyNotFound        = "API_KEY_NOT_FOUND"
+	CodeConfigReadFailed      = "CONFIG_READ_FAILED"
+	CodeConfigWriteFailed     = "CONFIG_WRITE_FAILED"
+	CodeDBReadFailed          = "DB_READ_FAILED"
+	CodeDBWriteFailed         = "DB_WRITE_FAILED"
+	CodeJournalFailed         = "JOURNAL_FAILED"
+	CodeRestartFailed         = "RESTART_FAILED"
+	CodePasswordGenFailed     = "PASSWORD_GENERATION_FAILED"
+	CodeExpiryCheckFailed     = "EXPIRY_CHECK_FAILED"
+	CodeReconcileFailed       = "RECONCILE_FAILED"
+	CodeApiKeyWriteFailed     = "API_KEY_WRITE_FAILED"
+	CodeAuditReadFailed       = "AUDIT_READ_FAILED"
+	CodeWebhookNotFound       = "WEBHOOK_NOT_FOUND"
+	CodeWebhookWriteFailed    = "WEBHOOK_WRITE_FAILED"
+	CodeDeliveryLogReadFailed = "DELIVERY_LOG_READ_FAILED"
+	CodeRateLimited           = "RATE_LIMITED"
+	CodeIPBanned              = "IP_BANNED"
+	CodeBanNotFound           = "BAN_NOT_FOUND"
+	CodeIPNotAllowed          = "IP_NOT_ALLOWED"
+	CodeNotReady              = "NOT_READY"
+	CodeInternal              = "INTERNAL_ERROR"
+)
+
+const (
+	langID = iota
+	langEN
+)
+
+// messages holds every API message in Indonesian and English, keyed by
+// message ID. Messages may contain fmt verbs for their arguments.
+var messages = map[string][2]string{
+	// Errors
+	"method_not_allowed":       {"Method not allowed", "Method not allowed"},
+	"invalid_body":             {"Invalid request body", "Invalid request body"},
+	"unauthorized":             {"Unauthorized", "Unauthorized"},
+	"forbidden_scope":          {"Forbidden: API key tidak punya scope %s", "Forbidden: API key lacks scope %s"},
+	"user_exists":              {"User sudah ada", "User already exists"},
+	"user_not_found":           {"User tidak ditemukan di database", "User not found in the database"},
+	"user_not_locked":          {"User tidak dalam status locked", "User is not locked"},
+	"batch_rejected":           {"Batch ditolak, tidak ada perubahan", "Batch rejected, nothing was changed"},
+	"api_key_not_found":        {"API key tidak ditemukan", "API key not found"},
+	"config_read_failed":       {"Gagal membaca config", "Failed to read config"},
+	"config_write_failed":      {"Gagal menyimpan config", "Failed to save config"},
+	"db_read_failed":           {"Gagal membaca database user", "Failed to read the user database"},
+	"db_write_failed":          {"Gagal menyimpan database user", "Failed to save the user database"},
+	"journal_failed":           {"Gagal menulis journal", "Failed to write the journal"},
+	"restart_failed":           {"Gagal merestart service", "Failed to restart the service"},
+	"password_gen_failed":      {"Gagal membuat password unik, perbesar password_length", "Could not generate a unique password, increase password_length"},
+	"expiry_check_failed":      {"Gagal menjalankan pengecekan expired: %v", "Expiry check failed: %v"},
+	"reconcile_failed":         {"Gagal reconcile: %v", "Reconcile failed: %v"},
+	"api_key_write_failed":     {"Gagal menyimpan API key", "Failed to save API key"},
+	"audit_read_failed":        {"Gagal membaca audit log", "Failed to read the audit log"},
+	"webhook_not_found":        {"Webhook tidak ditemukan", "Webhook not found"},
+	"webhook_write_failed":     {"Gagal menyimpan webhook", "Failed to save webhook"},
+	"delivery_log_read_failed": {"Gagal membaca log pengiriman webhook", "Failed to read the webhook delivery log"},
+	"rate_limited":             {"Terlalu banyak request, coba lagi dalam %d detik", "Too many requests, retry in %d seconds"},
+	"ip_banned":                {"IP diblokir sementara karena terlalu sering gagal autentikasi, coba lagi dalam %d detik", "IP temporarily banned after repeated authentication failures, retry in %d seconds"},
+	"ip_not_allowed":           {"IP %s tidak diizinkan", "IP %s is not allowed"},
+	"ip_not_allowed_key":       {"API key ini tidak boleh dipakai dari IP %s", "This API key may not be used from IP %s"},
+	"ban_not_found":            {"IP tidak sedang diblokir", "IP is not banned"},
+	"not_ready":                {"Belum siap: %s", "Not ready: %s"},
+	"internal_error":           {"Terjadi kesalahan internal", "Internal error"},
+
+	// Validation, the field name is in Response.Field
+	"duration_invalid":       {"Durasi (days/hours/minutes) harus valid", "Duration (days/hours/minutes) must be valid"},
+	"password_length":        {"%s harus 3-20 karakter", "%s must be 3-20 characters"},
+	"password_chars":         {"%s hanya boleh huruf, angka, - dan _", "%s may only contain letters, digits, - and _"},
+	"password_with_generate": {"%s harus kosong jika generate aktif", "%s must be empty when generate is set"},
+	"field_too_long":         {"%s maksimal %d karakter", "%s must be at most %d characters"},
+	"too_many_tags":          {"Maksimal %d tag", "At most %d tags"},
+	"field_required":         {"%s wajib diisi", "%s is required"},
+	"until_invalid":          {"until harus waktu RFC3339 yang akan datang", "until must be a future RFC3339 time"},
+	"expires_at_invalid":     {"expires_at harus RFC3339 di masa depan", "expires_at must be a future RFC3339 time"},
+	"bulk_mode_invalid":      {"Mode harus atomic atau best_effort", "Mode must be atomic or best_effort"},
+	"bulk_count_invalid":     {"Jumlah operasi harus 1-%d", "Number of operations must be 1-%d"},
+	"bulk_op_unknown":        {"Operasi tidak dikenal: %s", "Unknown operation: %s"},
+	"reconcile_mode_invalid": {"Mode harus dry-run atau apply", "Mode must be dry-run or apply"},
+	"status_filter_invalid":  {"status %q tidak valid, gunakan active, expired atau locked", "Invalid status %q, use active, expired or locked"},
+	"time_filter_invalid":    {"%s harus RFC3339 atau YYYY-MM-DD", "%s must be RFC3339 or YYYY-MM-DD"},
+	"time_invalid":           {"%s harus RFC3339", "%s must be RFC3339"},
+	"sort_invalid":           {"sort %q tidak valid, gunakan password, expired, created_at atau updated_at", "Invalid sort %q, use password, expired, created_at or updated_at"},
+	"limit_invalid":          {"limit harus 1-%d", "limit must be 1-%d"},
+	"cursor_invalid":         {"cursor tidak valid", "Invalid cursor"},
+	"last_event_id_invalid":  {"Last-Event-ID tidak valid", "Invalid Last-Event-ID"},
+	"ip_invalid":             {"ip harus alamat IP yang valid", "ip must be a valid IP address"},
+	"cidr_invalid":           {"IP atau CIDR tidak valid: %s", "Invalid IP or CIDR: %s"},
+	"url_invalid":            {"url harus berupa URL http:// atau https://", "url must be an http:// or https:// URL"},
+	"event_unknown":          {"Event tidak dikenal: %s", "Unknown event: %s"},
+	"scope_unknown":          {"Scope tidak dikenal: %s", "Unknown scope: %s"},
+
+	// Success
+	"user_created":       {"User berhasil dibuat", "User created"},
+	"user_deleted":       {"User berhasil dihapus", "User deleted"},
+	"user_renewed":       {"User berhasil diperpanjang", "User renewed"},
+	"user_updated":       {"User berhasil diperbarui", "User updated"},
+	"user_renamed":       {"Password berhasil diganti", "Password changed"},
+	"user_locked":        {"User berhasil dikunci", "User locked"},
+	"user_unlocked":      {"User berhasil dibuka", "User unlocked"},
+	"user_unlocked_exp":  {"User berhasil dibuka, tetapi sudah expired. Renew untuk mengaktifkan kembali", "User unlocked but already expired. Renew to reactivate"},
+	"user_list":          {"Daftar user", "User list"},
+	"user_detail":        {"Detail user", "User detail"},
+	"bulk_done":          {"Bulk selesai. Berhasil: %d, gagal: %d", "Bulk finished. Succeeded: %d, failed: %d"},
+	"system_info":        {"System Info", "System Info"},
+	"expiry_checked":     {"Pengecekan expired selesai. Dicabut: %d", "Expiration check complete. Revoked: %d"},
+	"cron_status":        {"Cron status", "Cron status"},
+	"reconcile_done":     {"Reconcile selesai. Selisih: %d, diperbaiki: %d", "Reconcile finished. Discrepancies: %d, fixed: %d"},
+	"restart_status":     {"Restart status", "Restart status"},
+	"healthy":            {"API berjalan", "API is running"},
+	"ready":              {"Siap", "Ready"},
+	"api_key_list":       {"Daftar API key", "API keys"},
+	"api_key_created":    {"API key berhasil dibuat. Simpan key ini, tidak akan ditampilkan lagi.", "API key created. Store it now, it will not be shown again."},
+	"api_key_revoked":    {"API key berhasil dicabut", "API key revoked"},
+	"audit_log":          {"Audit log", "Audit log"},
+	"webhook_list":       {"Daftar webhook", "Webhooks"},
+	"webhook_created":    {"Webhook berhasil dibuat. Simpan secret ini, tidak akan ditampilkan lagi.", "Webhook created. Store the secret now, it will not be shown again."},
+	"webhook_deleted":    {"Webhook berhasil dihapus", "Webhook deleted"},
+	"webhook_deliveries": {"Log pengiriman webhook", "Webhook deliveries"},
+	"ban_list":           {"Daftar IP yang diblokir", "Banned IPs"},
+	"bans_cleared":       {"%d blokir IP dihapus", "%d bans cleared"},
+}
+
+func translate(lang int, msg string, args ...interface{}) string {
+	text, ok := messages[msg]
+	if !ok {
+		return msg
+	}
+	if len(args) == 0 {
+		return text[lang]
+	}
+	return fmt.Sprintf(text[lang], args...)
+}
+
+// requestLang picks Indonesian or English from Accept-Language, honouring
+// q-values. Indonesian is the default.
+func requestLang(r *http.Request) int {
+	best, bestQ := langID, 0.0
+	for _, part := range strings.Split(r.Header.Get("Accept-Language"), ",") {
+		fields := strings.Split(strings.TrimSpace(part), ";")
+		tag := strings.ToLower(strings.SplitN(fields[0], "-", 2)[0])
+		q := 1.0
+		for _, f := range fields[1:] {
+			if v := strings.TrimSpace(f); strings.HasPrefix(v, "q=") {
+				q, _ = strconv.ParseFloat(v[2:], 64)
 			}
 		}
-		if changed {
-			config.Auth.Config = newConfigAuth
-			saveConfig(config)
-			restartService()
+		if q <= bestQ {
+			continue
+		}
+		switch tag {
+		case "id", "in":
+			best, bestQ = langID, q
+		case "en":
+			best, bestQ = langEN, q
 		}
 	}
+	return best
 }
 
-func enableUser(password string) {
+// apiError is a failure with a stable code, an HTTP status and a message
+// ID. Error returns the Indonesian message, as used in logs and the audit
+// log.
+type apiError struct {
+	Status int
+	Code   string
+	Field  string
+	Msg    string
+	Args   []interface{}
+}
+
+func (e *apiError) Error() string {
+	return e.Message(langID)
+}
+
+func (e *apiError) Message(lang int) string {
+	return translate(lang, e.Msg, e.Args...)
+}
+
+// validationError reports an invalid field with a 400 status.
+func validationError(field, msg string, args ...interface{}) *apiError {
+	return &apiError{Status: http.StatusBadRequest, Code: CodeValidation, Field: field, Msg: msg, Args: args}
+}
+
+var (
+	errMethodNotAllowed = &apiError{Status: http.StatusMethodNotAllowed, Code: CodeMethodNotAllowed, Msg: "method_not_allowed"}
+	errInvalidBody      = &apiError{Status: http.StatusBadRequest, Code: CodeInvalidBody, Msg: "invalid_body"}
+	errUnauthorized     = &apiError{Status: http.StatusUnauthorized, Code: CodeUnauthorized, Msg: "unauthorized"}
+	errUserExists       = &apiError{Status: http.StatusConflict, Code: CodeUserExists, Field: "password", Msg: "user_exists"}
+	errUserNotFound     = &apiError{Status: http.StatusNotFound, Code: CodeUserNotFound, Field: "password", Msg: "user_not_found"}
+	errUserNotLocked    = &apiError{Status: http.StatusConflict, Code: CodeUserNotLocked, Field: "password", Msg: "user_not_locked"}
+	errBatchRejected    = &apiError{Status: http.StatusBadRequest, Code: CodeBatchRejected, Msg: "batch_rejected"}
+	errApiKeyNotFound   = &apiError{Status: http.StatusNotFound, Code: CodeApiKeyNotFound, Field: "id", Msg: "api_key_not_found"}
+	errConfigRead       = &apiError{Status: http.StatusInternalServerError, Code: CodeConfigReadFailed, Msg: "config_read_failed"}
+	errConfigWrite      = &apiError{Status: http.StatusInternalServerError, Code: CodeConfigWriteFailed, Msg: "config_write_failed"}
+	errDBRead           = &apiError{Status: http.StatusInternalServerError, Code: CodeDBReadFailed, Msg: "db_read_failed"}
+	errDBWrite          = &apiError{Status: http.StatusInternalServerError, Code: CodeDBWriteFailed, Msg: "db_write_failed"}
+	errJournal          = &apiError{Status: http.StatusInternalServerError, Code: CodeJournalFailed, Msg: "journal_failed"}
+	errRestart          = &apiError{Status: http.StatusInternalServerError, Code: CodeRestartFailed, Msg: "restart_failed"}
+	errPasswordGen      = &apiError{Status: http.StatusInternalServerError, Code: CodePasswordGenFailed, Msg: "password_gen_failed"}
+	errApiKeyWrite      = &apiError{Status: http.StatusInternalServerError, Code: CodeApiKeyWriteFailed, Msg: "api_key_write_failed"}
+	errAuditRead        = &apiError{Status: http.StatusInternalServerError, Code: CodeAuditReadFailed, Msg: "audit_read_failed"}
+	errWebhookNotFound  = &apiError{Status: http.StatusNotFound, Code: CodeWebhookNotFound, Field: "id", Msg: "webhook_not_found"}
+	errWebhookWrite     = &apiError{Status: http.StatusInternalServerError, Code: CodeWebhookWriteFailed, Msg: "webhook_write_failed"}
+	errDeliveryLogRead  = &apiError{Status: http.StatusInternalServerError, Code: CodeDeliveryLogReadFailed, Msg: "delivery_log_read_failed"}
+	errBanNotFound      = &apiError{Status: http.StatusNotFound, Code: CodeBanNotFound, Field: "ip", Msg: "ban_not_found"}
+	errInternal         = &apiError{Status: http.StatusInternalServerError, Code: CodeInternal, Msg: "internal_error"}
+)
+
+type apiKeyContextKey struct{}
+
+// authMiddleware authenticates the request with a signature or X-API-Key,
+// checks that the key grants scope and stores the key in the request
+// context.
+func authMiddleware(scope string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var key ApiKey
+		if r.Header.Get("X-Signature") != "" {
+			var err error
+			if key, err = signatures.Verify(w, r); err != nil {
+				log.Printf("%s %s signature ditolak: %v", r.Method, r.URL.Path, err)
+				limiter.Failure(remoteIP(r))
+				writeError(w, r, errUnauthorized)
+				return
+			}
+		} else {
+			var ok bool
+			key, ok = apiKeys.Authenticate(r.Header.Get("X-API-Key"))
+			if !ok || signatures.required {
+				if !ok {
+					limiter.Failure(remoteIP(r))
+				}
+				writeError(w, r, errUnauthorized)
+				return
+			}
+		}
+		if ip := remoteIP(r); !key.allowsIP(ip) {
+			log.Printf("%s %s key=%s ditolak dari IP %s", r.Method, r.URL.Path, key.ID, ip)
+			writeError(w, r, &apiError{Status: http.StatusForbidden, Code: CodeIPNotAllowed, Msg: "ip_not_allowed_key", Args: []interface{}{ip}})
+			return
+		}
+		if !key.HasScope(scope) {
+			log.Printf("%s %s key=%s forbidden (butuh %s)", r.Method, r.URL.Path, key.ID, scope)
+			writeError(w, r, &apiError{Status: http.StatusForbidden, Code: CodeForbidden, Msg: "forbidden_scope", Args: []interface{}{scope}})
+			return
+		}
+		if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+			log.Printf("%s %s key=%s cert=%s", r.Method, r.URL.Path, key.ID, r.TLS.PeerCertificates[0].Subject.CommonName)
+		} else {
+			log.Printf("%s %s key=%s", r.Method, r.URL.Path, key.ID)
+		}
+		next(w, r.WithContext(context.WithValue(r.Context(), apiKeyContextKey{}, key)))
+	}
+}
+
+// requestKey returns the API key that authenticated r.
+func requestKey(r *http.Request) ApiKey {
+	key, _ := r.Context().Value(apiKeyContextKey{}).(ApiKey)
+	return key
+}
+
+func jsonResponse(w http.ResponseWriter, status int, resp Response) {
+	if aw, ok := w.(*auditResponseWriter); ok {
+		aw.message = resp.Message
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(resp)
+}
+
+// writeOK sends a success response. msg is a key in messages.
+func writeOK(w http.ResponseWriter, r *http.Request, data interface{}, msg string, args ...interface{}) {
+	writeOKMeta(w, r, data, nil, msg, args...)
+}
+
+func writeOKMeta(w http.ResponseWriter, r *http.Request, data, meta interface{}, msg string, args ...interface{}) {
+	jsonResponse(w, http.StatusOK, Response{
+		Success: true,
+		Message: translate(requestLang(r), msg, args...),
+		Data:    data,
+		Meta:    meta,
+	})
+}
+
+// writeError sends err as a failure response. Errors that are not an
+// *apiError are reported as INTERNAL_ERROR.
+func writeError(w http.ResponseWriter, r *http.Request, err error) {
+	writeErrorData(w, r, err, nil)
+}
+
+func writeErrorData(w http.ResponseWriter, r *http.Request, err error, data interface{}) {
+	var apiErr *apiError
+	if !errors.As(err, &apiErr) {
+		log.Printf("%s %s: %v", r.Method, r.URL.Path, err)
+		apiErr = errInternal
+	}
+	jsonResponse(w, apiErr.Status, Response{
+		Success: false,
+		Message: apiErr.Message(requestLang(r)),
+		Code:    apiErr.Code,
+		Field:   apiErr.Field,
+		Data:    data,
+	})
+}
+
+// writeRestartFailed answers RESTART_FAILED for a change that is already
+// saved. The audit entry still records the change as a success, with the
+// restart error attached, so the audit log, webhooks and the event stream
+// match what is stored.
+func writeRestartFailed(w http.ResponseWriter, r *http.Request, err error, data interface{}) {
+	log.Printf("%s %s: restart gagal: %v", r.Method, r.URL.Path, err)
+	auditFrom(r).RestartError = err.Error()
+	writeErrorData(w, r, errRestart, data)
+}
+
+func createUser(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, r, errMethodNotAllowed)
+		return
+	}
+
+	var req UserRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, r, errInvalidBody)
+		return
+	}
+
+	rec := auditFrom(r)
+	rec.Password = req.Password
+
+	if req.Duration() <= 0 {
+		writeError(w, r, validationError("days", "duration_invalid"))
+		return
+	}
+	if err := checkNewPassword("password", req.Password, req.Generate); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	tags, err := validateUserMeta(req.Owner, req.Note, req.Plan, req.Tags)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
 	mutex.Lock()
 	defer mutex.Unlock()
 
 	config, err := loadConfig()
 	if err != nil {
+		writeError(w, r, errConfigRead)
 		return
 	}
 
-	exists := false
+	inConfig := make(map[string]bool)
 	for _, p := range config.Auth.Config {
-		if p == password {
-			exists = true
-			break
+		inConfig[p] = true
+	}
+
+	if req.Generate {
+		req.Password, err = passwords.Generate(func(p string) bool {
+			if inConfig[p] {
+				return true
+			}
+			_, found, err := store.Get(p)
+			return found || err != nil
+		})
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		rec.Password = req.Password
+	}
+
+	// Any existing record counts, including locked or expired users; those
+	// are brought back with renew or unlock, not create.
+	_, hadUser, err := store.Get(req.Password)
+	if err != nil {
+		writeError(w, r, errDBRead)
+		return
+	}
+	if inConfig[req.Password] || hadUser {
+		writeError(w, r, errUserExists)
+		return
+	}
+
+	now := time.Now()
+	expDate := now.Add(req.Duration()).Format(time.RFC3339)
+
+	newUser := UserStore{
+		Password:  req.Password,
+		Expired:   expDate,
+		Status:    "active",
+		CreatedAt: now.Format(time.RFC3339),
+		UpdatedAt: now.Format(time.RFC3339),
+		Owner:     strings.TrimSpace(req.Owner),
+		Note:      strings.TrimSpace(req.Note),
+		Tags:      tags,
+		Plan:      strings.TrimSpace(req.Plan),
+	}
+
+	rec.After = &newUser
+	if err := beginMutation("create", journalChange{Password: req.Password, Before: journalState{InConfig: false}, After: journalState{InConfig: true, User: &newUser}}); err != nil {
+		writeError(w, r, errJournal)
+		return
+	}
+
+	config.Auth.Config = append(config.Auth.Config, req.Password)
+	if err := saveConfig(config); err != nil {
+		abortMutation()
+		writeError(w, r, errConfigWrite)
+		return
+	}
+
+	if err := store.Put(newUser); err != nil {
+		abortMutation()
+		writeError(w, r, errDBWrite)
+		return
+	}
+
+	commitMutation()
+
+	restart, err := restarts.Request()
+	if err != nil {
+		writeRestartFailed(w, r, err, nil)
+		return
+	}
+
+	domain := "Tidak diatur"
+	if domainBytes, err := ioutil.ReadFile(DomainFile); err == nil {
+		domain = strings.TrimSpace(string(domainBytes))
+	}
+
+	writeOK(w, r, map[string]string{
+		"password": req.Password,
+		"expired":  expDate,
+		"domain":   domain,
+		"restart":  restart,
+	}, "user_created")
+}
+
+func deleteUser(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, r, errMethodNotAllowed)
+		return
+	}
+
+	var req UserRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, r, errInvalidBody)
+		return
+	}
+
+	rec := auditFrom(r)
+	rec.Password = req.Password
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	config, err := loadConfig()
+	if err != nil {
+		writeError(w, r, errConfigRead)
+		return
+	}
+
+	foundInConfig := false
+	newConfigAuth := []string{}
+	for _, p := range config.Auth.Config {
+		if p == req.Password {
+			foundInConfig = true
+		} else {
+			newConfigAuth = append(newConfigAuth, p)
+		}
+	}
+
+	prevUser, foundInDB, err := store.Get(req.Password)
+	if err != nil {
+		writeError(w, r, errDBRead)
+		return
+	}
+
+	if !foundInConfig && !foundInDB {
+		writeError(w, r, errUserNotFound)
+		return
+	}
+
+	before := journalState{InConfig: foundInConfig}
+	if foundInDB {
+		before.User = &prevUser
+		rec.Before = &prevUser
+	}
+	if err := beginMutation("delete", journalChange{Password: req.Password, Before: before, After: journalState{InConfig: false}}); err != nil {
+		writeError(w, r, errJournal)
+		return
+	}
+
+	if foundInConfig {
+		config.Auth.Config = newConfigAuth
+		if err := saveConfig(config); err != nil {
+			abortMutation()
+			writeError(w, r, errConfigWrite)
+			return
+		}
+	}
+
+	if foundInDB {
+		if _, err := store.Delete(req.Password); err != nil {
+			abortMutation()
+			writeError(w, r, errDBWrite)
+			return
+		}
+	}
+
+	commitMutation()
+
+	restart := RestartNone
+	if foundInConfig {
+		if restart, err = restarts.Request(); err != nil {
+			writeRestartFailed(w, r, err, nil)
+			return
+		}
+	}
+
+	writeOK(w, r, map[string]string{
+		"restart": restart,
+	}, "user_deleted")
+}
+
+func renewUser(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, r, errMethodNotAllowed)
+		return
+	}
+
+	var req UserRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, r, errInvalidBody)
+		return
+	}
+
+	rec := auditFrom(r)
+	rec.Password = req.Password
+
+	if req.Duration() <= 0 {
+		writeError(w, r, validationError("days", "duration_invalid"))
+		return
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	u, found, err := store.Get(req.Password)
+	if err != nil {
+		writeError(w, r, errDBRead)
+		return
+	}
+
+	if !found {
+		writeError(w, r, errUserNotFound)
+		return
+	}
+	before := u
+	rec.Before = &before
+	rec.After = &u
+
+	now := time.Now()
+	newExpDate := extendExpiry(u.Expired, req.Duration(), now)
+
+	u.Expired = newExpDate
+	u.UpdatedAt = now.Format(time.RFC3339)
+
+	if u.Status == "locked" {
+		u.Status = "active"
+		u.LockReason, u.LockedUntil = "", ""
+	}
+
+	// Locked users and users already revoked by the expiry sweep are both
+	// missing from auth.config, so put the password back either way.
+	restart, err := saveUserAccessLocked("renew", before, u, true)
+	if err == errRestart {
+		writeRestartFailed(w, r, err, nil)
+		return
+	}
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	writeOK(w, r, map[string]string{
+		"password": req.Password,
+		"expired":  newExpDate,
+		"restart":  restart,
+	}, "user_renewed")
+}
+
+// renameUser changes a user's password. Expiry, status and metadata move
+// to the new password, and auth.config keeps the entry in place, so the
+// change is written once and restarts the service once.
+func renameUser(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, r, errMethodNotAllowed)
+		return
+	}
+
+	var req RenameRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, r, errInvalidBody)
+		return
+	}
+
+	rec := auditFrom(r)
+	rec.Password = req.Password
+
+	if err := checkNewPassword("new_password", req.NewPassword, req.Generate); err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	config, err := loadConfig()
+	if err != nil {
+		writeError(w, r, errConfigRead)
+		return
+	}
+	users, err := loadUsers()
+	if err != nil {
+		writeError(w, r, errDBRead)
+		return
+	}
+
+	set := newMutationSet(config, users)
+	if req.Generate {
+		req.NewPassword, err = passwords.Generate(set.Exists)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+	}
+
+	before, after, err := set.Rename(req.Password, req.NewPassword, time.Now())
+	rec.Before = before
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	rec.After = after
+	rec.Detail = req.Password + " -> " + req.NewPassword
+
+	if err := beginMutation("rename", set.Changes()...); err != nil {
+		writeError(w, r, errJournal)
+		return
+	}
+	if set.ConfigChanged() {
+		config.Auth.Config = set.Auth()
+		if err := saveConfig(config); err != nil {
+			abortMutation()
+			writeError(w, r, errConfigWrite)
+			return
+		}
+	}
+	if err := saveUsers(set.Users()); err != nil {
+		abortMutation()
+		writeError(w, r, errDBWrite)
+		return
+	}
+	commitMutation()
+
+	if err := renameTelegramMappings(req.Password, after.Password); err != nil {
+		log.Printf("Gagal memperbarui %s: %v", TelegramMappingsFile, err)
+	}
+
+	restart := RestartNone
+	if set.ConfigChanged() {
+		if restart, err = restarts.Request(); err != nil {
+			writeRestartFailed(w, r, err, nil)
+			return
+		}
+	}
+
+	writeOK(w, r, map[string]string{
+		"old_password": req.Password,
+		"password":     after.Password,
+		"expired":      formatExpiry(after.Expired),
+		"owner":        after.Owner,
+		"restart":      restart,
+	}, "user_renamed")
+}
+
+// renameTelegramMappings points every Telegram mapping of from at to. A
+// missing file means the bot has no mappings yet.
+func renameTelegramMappings(from, to string) error {
+	data, err := ioutil.ReadFile(TelegramMappingsFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	mappings := make(map[string]string)
+	if err := json.Unmarshal(data, &mappings); err != nil {
+		return err
+	}
+
+	changed := false
+	for id, password := range mappings {
+		if password == from {
+			mappings[id] = to
+			changed = true
+		}
+	}
+	if !changed {
+		return nil
+	}
+	data, err = json.MarshalIndent(mappings, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(TelegramMappingsFile, data, 0644)
+}
+
+// lockUser cuts a user off without deleting the record. The password is
+// removed from auth.config until the user is unlocked or renewed.
+func lockUser(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, r, errMethodNotAllowed)
+		return
+	}
+
+	var req LockRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, r, errInvalidBody)
+		return
+	}
+
+	rec := auditFrom(r)
+	rec.Password = req.Password
+
+	now := time.Now()
+	reason, until, err := req.Fields(now)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	u, found, err := store.Get(req.Password)
+	if err != nil {
+		writeError(w, r, errDBRead)
+		return
+	}
+	if !found {
+		writeError(w, r, errUserNotFound)
+		return
+	}
+	before := u
+	rec.Before = &before
+
+	u.Status = "locked"
+	u.LockReason = reason
+	u.LockedUntil = until
+	u.UpdatedAt = now.Format(time.RFC3339)
+	rec.After = &u
+
+	restart, err := saveUserAccessLocked("lock", before, u, false)
+	if err == errRestart {
+		writeRestartFailed(w, r, err, nil)
+		return
+	}
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	if until != "" {
+		wakeAutoUnlock()
+	}
+
+	writeOK(w, r, map[string]string{
+		"password":     u.Password,
+		"lock_reason":  u.LockReason,
+		"locked_until": u.LockedUntil,
+		"restart":      restart,
+	}, "user_locked")
+}
+
+func unlockUser(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, r, errMethodNotAllowed)
+		return
+	}
+
+	var req UserRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, r, errInvalidBody)
+		return
+	}
+
+	rec := auditFrom(r)
+	rec.Password = req.Password
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	u, found, err := store.Get(req.Password)
+	if err != nil {
+		writeError(w, r, errDBRead)
+		return
+	}
+	if !found {
+		writeError(w, r, errUserNotFound)
+		return
+	}
+	if u.Status != "locked" {
+		writeError(w, r, errUserNotLocked)
+		return
+	}
+	before := u
+	rec.Before = &before
+
+	u, restart, err := unlockUserLocked(u, time.Now(), "unlock")
+	if err == errRestart {
+		rec.After = &u
+		writeRestartFailed(w, r, err, nil)
+		return
+	}
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	rec.After = &u
+
+	message := "user_unlocked"
+	if isExpired(u, time.Now()) {
+		message = "user_unlocked_exp"
+	}
+	writeOK(w, r, map[string]string{
+		"password": u.Password,
+		"expired":  formatExpiry(u.Expired),
+		"restart":  restart,
+	}, message)
+}
+
+// unlockUserLocked marks u active and puts the password back in
+// auth.config unless it has already expired. Callers must hold mutex.
+func unlockUserLocked(u UserStore, now time.Time, action string) (UserStore, string, error) {
+	prev := u
+	u.Status = "active"
+	u.LockReason, u.LockedUntil = "", ""
+	u.UpdatedAt = now.Format(time.RFC3339)
+	restart, err := saveUserAccessLocked(action, prev, u, !isExpired(u, now))
+	return u, restart, err
+}
+
+// saveUserAccessLocked stores u and adds or removes its password from
+// auth.config as one journalled mutation. The restart is requested after
+// the mutation is committed, so a failed restart leaves both files
+// changed and returns errRestart. Callers must hold mutex.
+func saveUserAccessLocked(action string, prev, u UserStore, enable bool) (string, error) {
+	config, err := loadConfig()
+	if err != nil {
+		return RestartNone, errConfigRead
+	}
+	inConfig := false
+	for _, p := range config.Auth.Config {
+		if p == u.Password {
+			inConfig = true
+			break
+		}
+	}
+
+	change := journalChange{
+		Password: u.Password,
+		Before:   journalState{InConfig: inConfig, User: &prev},
+		After:    journalState{InConfig: enable, User: &u},
+	}
+	if err := beginMutation(action, change); err != nil {
+		return RestartNone, errJournal
+	}
+
+	if err := store.Put(u); err != nil {
+		abortMutation()
+		return RestartNone, errDBWrite
+	}
+
+	changed, err := setAccessLocked(config, u.Password, enable)
+	if err != nil {
+		abortMutation()
+		return RestartNone, errConfigWrite
+	}
+	commitMutation()
+	if !changed {
+		return RestartNone, nil
+	}
+
+	restart, err := restarts.Request()
+	if err != nil {
+		log.Printf("Restart setelah %s %s: %v", action, u.Password, err)
+		return RestartNone, errRestart
+	}
+	return restart, nil
+}
+
+// unlockWake interrupts runAutoUnlock's wait after a timed lock is set.
+var unlockWake = make(chan struct{}, 1)
+
+func wakeAutoUnlock() {
+	select {
+	case unlockWake <- struct{}{}:
+	default:
+	}
+}
+
+// runAutoUnlock unlocks users when their locked_until passes. It runs on
+// its own timer, independent of expiry_schedule, sleeping until the next
+// locked_until and at most a minute. It never returns.
+func runAutoUnlock() {
+	for {
+		_, next, err := unlockDueUsers("scheduler")
+		if err != nil {
+			log.Printf("Auto-unlock: %v", err)
+		}
+		wait := time.Minute
+		if !next.IsZero() {
+			if d := time.Until(next); d < wait {
+				wait = d
+			}
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-unlockWake:
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+}
+
+// unlockDueUsers unlocks locked users whose locked_until has passed. It
+// also returns the earliest locked_until still ahead, or the zero time.
+func unlockDueUsers(actor string) (int, time.Time, error) {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	users, err := loadUsers()
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+
+	now := time.Now()
+	unlocked := 0
+	var next time.Time
+	for _, u := range users {
+		if u.Status != "locked" || u.LockedUntil == "" {
+			continue
+		}
+		until, err := time.Parse(time.RFC3339, u.LockedUntil)
+		if err != nil {
+			continue
+		}
+		if until.After(now) {
+			if next.IsZero() || until.Before(next) {
+				next = until
+			}
+			continue
+		}
+
+		before := u
+		entry := AuditEntry{Action: "unlock", Actor: actor, Password: u.Password, Before: &before, Detail: "auto"}
+		after, _, err := unlockUserLocked(u, now, "unlock")
+		if err != nil && err != errRestart {
+			log.Printf("Auto-unlock %s: %v", u.Password, err)
+			entry.Result, entry.Message = "error", err.Error()
+		} else {
+			// errRestart means the unlock is saved and only the restart failed.
+			if err != nil {
+				entry.RestartError = err.Error()
+			}
+			log.Printf("User %s unlocked (locked until %s)", u.Password, u.LockedUntil)
+			entry.After = &after
+			entry.Result, entry.Message = "success", "Dibuka otomatis (locked_until "+u.LockedUntil+")"
+			unlocked++
+		}
+		auditLog.Record(entry)
+	}
+	return unlocked, next, nil
+}
+
+// updateUser changes owner, note, tags and plan. It never touches
+// auth.config, so the service is not restarted.
+func updateUser(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, r, errMethodNotAllowed)
+		return
+	}
+
+	var req UserUpdateRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, r, errInvalidBody)
+		return
+	}
+
+	rec := auditFrom(r)
+	rec.Password = req.Password
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	u, found, err := store.Get(req.Password)
+	if err != nil {
+		writeError(w, r, errDBRead)
+		return
+	}
+	if !found {
+		writeError(w, r, errUserNotFound)
+		return
+	}
+	before := u
+	rec.Before = &before
+
+	if req.Owner != nil {
+		u.Owner = strings.TrimSpace(*req.Owner)
+	}
+	if req.Note != nil {
+		u.Note = strings.TrimSpace(*req.Note)
+	}
+	if req.Plan != nil {
+		u.Plan = strings.TrimSpace(*req.Plan)
+	}
+	tags := u.Tags
+	if req.Tags != nil {
+		tags = *req.Tags
+	}
+	if u.Tags, err = validateUserMeta(u.Owner, u.Note, u.Plan, tags); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	u.UpdatedAt = time.Now().Format(time.RFC3339)
+	rec.After = &u
+
+	if err := store.Put(u); err != nil {
+		writeError(w, r, errDBWrite)
+		return
+	}
+
+	u.Expired = formatExpiry(u.Expired)
+	writeOK(w, r, u, "user_updated")
+}
+
+const (
+	maxOwnerLen = 64
+	maxNoteLen  = 500
+	maxPlanLen  = 64
+	maxTags     = 20
+	maxTagLen   = 32
+)
+
+// validateUserMeta checks the metadata lengths and returns the tags
+// trimmed, without empty entries or duplicates.
+func validateUserMeta(owner, note, plan string, tags []string) ([]string, error) {
+	if len(strings.TrimSpace(owner)) > maxOwnerLen {
+		return nil, validationError("owner", "field_too_long", "owner", maxOwnerLen)
+	}
+	if len(strings.TrimSpace(note)) > maxNoteLen {
+		return nil, validationError("note", "field_too_long", "note", maxNoteLen)
+	}
+	if len(strings.TrimSpace(plan)) > maxPlanLen {
+		return nil, validationError("plan", "field_too_long", "plan", maxPlanLen)
+	}
+
+	var clean []string
+	seen := make(map[string]bool)
+	for _, t := range tags {
+		t = strings.TrimSpace(t)
+		if t == "" || seen[t] {
+			continue
+		}
+		if len(t) > maxTagLen {
+			return nil, validationError("tags", "field_too_long", "tag", maxTagLen)
+		}
+		seen[t] = true
+		clean = append(clean, t)
+	}
+	if len(clean) > maxTags {
+		return nil, validationError("tags", "too_many_tags", maxTags)
+	}
+	return clean, nil
+}
+
+// passwordPattern is the policy both bots already enforce on input.
+var (
+	passwordPattern = regexp.MustCompile(`^[a-zA-Z0-9_-]{3,20}$`)
+	passwordChars   = regexp.MustCompile(`^[a-zA-Z0-9_-]*$`)
+)
+
+// validatePassword checks password against the policy. field names the
+// request field in the error.
+func validatePassword(field, password string) error {
+	if len(password) < 3 || len(password) > 20 {
+		return validationError(field, "password_length", field)
+	}
+	if !passwordPattern.MatchString(password) {
+		return validationError(field, "password_chars", field)
+	}
+	return nil
+}
+
+// checkNewPassword validates a password that is either given by the
+// client or left empty with generate set.
+func checkNewPassword(field, password string, generate bool) error {
+	if generate {
+		if password != "" {
+			return validationError(field, "password_with_generate", field)
+		}
+		return nil
+	}
+	return validatePassword(field, password)
+}
+
+const maxGenerateAttempts = 20
+
+type passwordGenerator struct {
+	length  int
+	charset string
+	prefix  string
+}
+
+// Check makes sure every generated password passes validatePassword and
+// that the pattern leaves enough room for random characters.
+func (g *passwordGenerator) Check() error {
+	if g.charset == "" || !passwordChars.MatchString(g.charset) {
+		return errors.New("password_charset hanya boleh huruf, angka, - dan _")
+	}
+	if !passwordChars.MatchString(g.prefix) {
+		return errors.New("password_prefix hanya boleh huruf, angka, - dan _")
+	}
+	if g.length < 3 || g.length > 20 {
+		return errors.New("password_length harus 3-20")
+	}
+	if g.length-len(g.prefix) < 4 {
+		return errors.New("password_length harus minimal 4 lebih panjang dari password_prefix")
+	}
+	return nil
+}
+
+// Generate returns a random password for which exists reports false.
+func (g *passwordGenerator) Generate(exists func(string) bool) (string, error) {
+	buf := make([]byte, g.length-len(g.prefix))
+	for i := 0; i < maxGenerateAttempts; i++ {
+		if _, err := rand.Read(buf); err != nil {
+			return "", err
+		}
+		password := []byte(g.prefix)
+		for _, b := range buf {
+			password = append(password, g.charset[int(b)%len(g.charset)])
+		}
+		if !exists(string(password)) {
+			return string(password), nil
+		}
+	}
+	return "", errPasswordGen
+}
+
+const maxBulkOperations = 1000
+
+type BulkResult struct {
+	Index    int    `json:"index"`
+	Op       string `json:"op"`
+	Password string `json:"password"`
+	Success  bool   `json:"success"`
+	Message  string `json:"message"`
+	Code     string `json:"code,omitempty"`
+	Field    string `json:"field,omitempty"`
+	Expired  string `json:"expired,omitempty"`
+}
+
+// bulkUsers applies a batch of operations with one config write and one
+// restart. In atomic mode any invalid item rejects the whole batch; in
+// best_effort mode invalid items are skipped and reported.
+func bulkUsers(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, r, errMethodNotAllowed)
+		return
+	}
+
+	req := BulkRequest{Mode: "atomic"}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, r, errInvalidBody)
+		return
+	}
+
+	if req.Mode != "atomic" && req.Mode != "best_effort" {
+		writeError(w, r, validationError("mode", "bulk_mode_invalid"))
+		return
+	}
+	if len(req.Operations) == 0 || len(req.Operations) > maxBulkOperations {
+		writeError(w, r, validationError("operations", "bulk_count_invalid", maxBulkOperations))
+		return
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	config, err := loadConfig()
+	if err != nil {
+		writeError(w, r, errConfigRead)
+		return
+	}
+	users, err := loadUsers()
+	if err != nil {
+		writeError(w, r, errDBRead)
+		return
+	}
+
+	set := newMutationSet(config, users)
+	now := time.Now()
+	lang := requestLang(r)
+	results := make([]BulkResult, len(req.Operations))
+	audits := make([]AuditEntry, 0, len(req.Operations))
+	failed := 0
+	for i, op := range req.Operations {
+		result := BulkResult{Index: i, Op: op.Op, Password: op.Password, Success: true, Message: "OK"}
+		entry := AuditEntry{Action: op.Op, Actor: requestKey(r).ID, SourceIP: remoteIP(r), Password: op.Password, Detail: "bulk"}
+
+		before, after, err := set.Apply(op, now)
+		entry.Before = before
+		if after != nil {
+			result.Password, entry.Password = after.Password, after.Password
+		}
+		if err != nil {
+			failed++
+			result.Success, result.Message = false, err.Error()
+			if apiErr, ok := err.(*apiError); ok {
+				result.Message, result.Code, result.Field = apiErr.Message(lang), apiErr.Code, apiErr.Field
+			}
+			entry.Result, entry.Message = "error", err.Error()
+		} else {
+			entry.After = after
+			entry.Result = "success"
+			if after != nil {
+				result.Expired = formatExpiry(after.Expired)
+			}
+		}
+		results[i] = result
+		audits = append(audits, entry)
+	}
+
+	data := map[string]interface{}{
+		"mode":      req.Mode,
+		"applied":   false,
+		"succeeded": len(results) - failed,
+		"failed":    failed,
+		"results":   results,
+		"restart":   RestartNone,
+	}
+	auditFrom(r).Detail = fmt.Sprintf("%s: %d operasi, %d gagal", req.Mode, len(results), failed)
+
+	if req.Mode == "atomic" && failed > 0 {
+		data["succeeded"] = 0
+		writeErrorData(w, r, errBatchRejected, data)
+		return
+	}
+
+	changes := set.Changes()
+	if len(changes) > 0 {
+		if err := beginMutation("bulk", changes...); err != nil {
+			writeError(w, r, errJournal)
+			return
+		}
+
+		config.Auth.Config = set.Auth()
+		if err := saveConfig(config); err != nil {
+			abortMutation()
+			writeError(w, r, errConfigWrite)
+			return
+		}
+		if err := saveUsers(set.Users()); err != nil {
+			abortMutation()
+			writeError(w, r, errDBWrite)
+			return
+		}
+		commitMutation()
+		// A lock in the batch may carry an until.
+		wakeAutoUnlock()
+	}
+	data["applied"] = true
+
+	var restartErr error
+	if set.ConfigChanged() {
+		data["restart"], restartErr = restarts.Request()
+	}
+	for _, entry := range audits {
+		if restartErr != nil && entry.Result == "success" {
+			entry.RestartError = restartErr.Error()
+		}
+		auditLog.Record(entry)
+	}
+	if restartErr != nil {
+		data["restart"] = RestartNone
+		writeRestartFailed(w, r, restartErr, data)
+		return
+	}
+
+	writeOK(w, r, data, "bulk_done", len(results)-failed, failed)
+}
+
+// listUsers returns every user unless query parameters narrow it down.
+// Without limit the response is the full list, as older clients expect.
+func listUsers(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, r, errMethodNotAllowed)
+		return
+	}
+
+	query, err := parseUserQuery(r.URL.Query())
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	users, err := loadUsers()
+	if err != nil {
+		writeError(w, r, errDBRead)
+		return
+	}
+
+	now := time.Now()
+	meta := UserListMeta{
+		Total:  len(users),
+		Counts: map[string]int{"active": 0, "expired": 0, "locked": 0},
+	}
+
+	type entry struct {
+		info UserInfo
+		key  string
+	}
+	matched := []entry{}
+	for _, u := range users {
+		info := newUserInfo(u, now)
+		meta.Counts[strings.ToLower(info.Status)]++
+		if query.Match(u, info) {
+			matched = append(matched, entry{info: info, key: query.SortKey(u)})
+		}
+	}
+	meta.Matched = len(matched)
+
+	less := func(a, b entry) bool {
+		if a.key != b.key {
+			return a.key < b.key
+		}
+		return a.info.Password < b.info.Password
+	}
+	sort.SliceStable(matched, func(i, j int) bool {
+		if query.Desc {
+			return less(matched[j], matched[i])
+		}
+		return less(matched[i], matched[j])
+	})
+
+	start := 0
+	if query.Cursor != nil {
+		cursor := entry{key: query.Cursor.Key, info: UserInfo{Password: query.Cursor.Password}}
+		start = sort.Search(len(matched), func(i int) bool {
+			if query.Desc {
+				return less(matched[i], cursor)
+			}
+			return less(cursor, matched[i])
+		})
+	}
+	end := len(matched)
+	if query.Limit > 0 && start+query.Limit < end {
+		end = start + query.Limit
+		last := matched[end-1]
+		meta.NextCursor = encodeUserCursor(last.key, last.info.Password)
+	}
+
+	userList := []UserInfo{}
+	for _, e := range matched[start:end] {
+		userList = append(userList, e.info)
+	}
+	meta.Returned = len(userList)
+
+	writeOKMeta(w, r, userList, meta, "user_list")
+}
+
+type UserListMeta struct {
+	Total      int            `json:"total"`   // All users in the database
+	Matched    int            `json:"matched"` // Users that pass the filters
+	Returned   int            `json:"returned"`
+	NextCursor string         `json:"next_cursor,omitempty"`
+	Counts     map[string]int `json:"counts"` // Per status, over all users
+}
+
+const maxUserListLimit = 1000
+
+// UserQuery holds the filters, sort order and page of a /api/users
+// request.
+type UserQuery struct {
+	Statuses       map[string]bool // Lower case UserInfo.Status, empty for all
+	ExpiringBefore time.Time
+	ExpiringAfter  time.Time
+	Owner          string
+	Tag            string
+	Search         string // Lower case substring of password, owner or note
+	SortBy         string // "password", "expired", "created_at" or "updated_at"
+	Desc           bool
+	Limit          int // 0 returns every match
+	Cursor         *userCursor
+}
+
+type userCursor struct {
+	Key      string
+	Password string
+}
+
+func parseUserQuery(values url.Values) (UserQuery, error) {
+	q := UserQuery{
+		Statuses: make(map[string]bool),
+		Owner:    values.Get("owner"),
+		Tag:      values.Get("tag"),
+		Search:   strings.ToLower(values.Get("q")),
+		SortBy:   "password",
+	}
+
+	if status := values.Get("status"); status != "" {
+		for _, st := range strings.Split(status, ",") {
+			st = strings.ToLower(strings.TrimSpace(st))
+			if st != "active" && st != "expired" && st != "locked" {
+				return q, validationError("status", "status_filter_invalid", st)
+			}
+			q.Statuses[st] = true
+		}
+	}
+
+	var err error
+	if v := values.Get("expiring_before"); v != "" {
+		if q.ExpiringBefore, err = parseQueryTime(v); err != nil {
+			return q, validationError("expiring_before", "time_filter_invalid", "expiring_before")
+		}
+	}
+	if v := values.Get("expiring_after"); v != "" {
+		if q.ExpiringAfter, err = parseQueryTime(v); err != nil {
+			return q, validationError("expiring_after", "time_filter_invalid", "expiring_after")
+		}
+	}
+
+	if v := values.Get("sort"); v != "" {
+		q.Desc = strings.HasPrefix(v, "-")
+		q.SortBy = strings.TrimPrefix(v, "-")
+		switch q.SortBy {
+		case "password", "expired", "created_at", "updated_at":
+		default:
+			return q, validationError("sort", "sort_invalid", q.SortBy)
+		}
+	}
+
+	if v := values.Get("limit"); v != "" {
+		if q.Limit, err = strconv.Atoi(v); err != nil || q.Limit < 1 || q.Limit > maxUserListLimit {
+			return q, validationError("limit", "limit_invalid", maxUserListLimit)
+		}
+	}
+	if v := values.Get("cursor"); v != "" {
+		if q.Cursor, err = decodeUserCursor(v); err != nil {
+			return q, validationError("cursor", "cursor_invalid")
+		}
+	}
+	return q, nil
+}
+
+// parseQueryTime reads an RFC3339 time or a date, which means the start
+// of that day in local time.
+func parseQueryTime(v string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, v); err == nil {
+		return t, nil
+	}
+	return time.ParseInLocation("2006-01-02", v, time.Local)
+}
+
+func (q UserQuery) Match(u UserStore, info UserInfo) bool {
+	if len(q.Statuses) > 0 && !q.Statuses[strings.ToLower(info.Status)] {
+		return false
+	}
+	if !q.ExpiringBefore.IsZero() || !q.ExpiringAfter.IsZero() {
+		exp, err := parseExpiry(u.Expired)
+		if err != nil {
+			return false
+		}
+		if !q.ExpiringBefore.IsZero() && !exp.Before(q.ExpiringBefore) {
+			return false
+		}
+		if !q.ExpiringAfter.IsZero() && !exp.After(q.ExpiringAfter) {
+			return false
+		}
+	}
+	if q.Owner != "" && u.Owner != q.Owner {
+		return false
+	}
+	if q.Tag != "" {
+		found := false
+		for _, t := range u.Tags {
+			if t == q.Tag {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if q.Search != "" &&
+		!strings.Contains(strings.ToLower(u.Password), q.Search) &&
+		!strings.Contains(strings.ToLower(u.Owner), q.Search) &&
+		!strings.Contains(strings.ToLower(u.Note), q.Search) {
+		return false
+	}
+	return true
+}
+
+// SortKey returns a string that orders u by q.SortBy. Times are written
+// in a fixed-width UTC form so they compare correctly as strings; missing
+// or unreadable times sort first.
+func (q UserQuery) SortKey(u UserStore) string {
+	var raw string
+	switch q.SortBy {
+	case "expired":
+		t, err := parseExpiry(u.Expired)
+		if err != nil {
+			return ""
+		}
+		return t.UTC().Format(sortTimeLayout)
+	case "created_at":
+		raw = u.CreatedAt
+	case "updated_at":
+		raw = u.UpdatedAt
+	default:
+		return ""
+	}
+	t, err := time.Parse(time.RFC3339, raw)
+	if err != nil {
+		return ""
+	}
+	return t.UTC().Format(sortTimeLayout)
+}
+
+const sortTimeLayout = "2006-01-02T15:04:05.000000000Z"
+
+// A cursor is the sort key and password of the last user on the previous
+// page, so pages stay stable when users are added or removed.
+func encodeUserCursor(key, password string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(key + "\x00" + password))
+}
+
+func decodeUserCursor(v string) (*userCursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(v)
+	if err != nil {
+		return nil, err
+	}
+	parts := strings.SplitN(string(raw), "\x00", 2)
+	if len(parts) != 2 {
+		return nil, errors.New("cursor tidak valid")
+	}
+	return &userCursor{Key: parts[0], Password: parts[1]}, nil
+}
+
+type UserInfo struct {
+	Password  string   `json:"password"`
+	Expired   string   `json:"expired"`
+	Status    string   `json:"status"` // "Active", "Locked" or "Expired"
+	CreatedAt string   `json:"created_at,omitempty"`
+	UpdatedAt string   `json:"updated_at,omitempty"`
+	Owner     string   `json:"owner,omitempty"`
+	Note      string   `json:"note,omitempty"`
+	Tags      []string `json:"tags,omitempty"`
+	Plan      string   `json:"plan,omitempty"`
+
+	LockReason  string `json:"lock_reason,omitempty"`
+	LockedUntil string `json:"locked_until,omitempty"`
+}
+
+func newUserInfo(u UserStore, now time.Time) UserInfo {
+	status := "Active"
+	if u.Status == "locked" {
+		status = "Locked"
+	} else if isExpired(u, now) {
+		status = "Expired"
+	}
+
+	return UserInfo{
+		Password:  u.Password,
+		Expired:   formatExpiry(u.Expired),
+		Status:    status,
+		CreatedAt: u.CreatedAt,
+		UpdatedAt: u.UpdatedAt,
+		Owner:     u.Owner,
+		Note:      u.Note,
+		Tags:      u.Tags,
+		Plan:      u.Plan,
+
+		LockReason:  u.LockReason,
+		LockedUntil: u.LockedUntil,
+	}
+}
+
+// UserDetail is a single user with the remaining time worked out, so
+// clients do not have to parse the expiry themselves.
+type UserDetail struct {
+	UserInfo
+	RemainingDays    int   `json:"remaining_days"`
+	RemainingHours   int   `json:"remaining_hours"` // On top of remaining_days
+	RemainingSeconds int64 `json:"remaining_seconds"`
+	InConfig         bool  `json:"in_config"`
+	// LastModified is updated_at, or created_at for records that were
+	// never changed. Empty for records older than both fields.
+	LastModified string `json:"last_modified,omitempty"`
+}
+
+func getUser(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, r, errMethodNotAllowed)
+		return
+	}
+
+	password := r.URL.Query().Get("password")
+	if password == "" {
+		writeError(w, r, validationError("password", "field_required", "password"))
+		return
+	}
+
+	u, found, err := store.Get(password)
+	if err != nil {
+		writeError(w, r, errDBRead)
+		return
+	}
+	if !found {
+		writeError(w, r, errUserNotFound)
+		return
+	}
+
+	config, err := loadConfig()
+	if err != nil {
+		writeError(w, r, errConfigRead)
+		return
+	}
+
+	now := time.Now()
+	detail := UserDetail{UserInfo: newUserInfo(u, now)}
+	for _, p := range config.Auth.Config {
+		if p == password {
+			detail.InConfig = true
+			break
+		}
+	}
+	if exp, err := parseExpiry(u.Expired); err == nil && exp.After(now) {
+		remaining := exp.Sub(now)
+		detail.RemainingSeconds = int64(remaining / time.Second)
+		detail.RemainingDays = int(remaining / (24 * time.Hour))
+		detail.RemainingHours = int(remaining % (24 * time.Hour) / time.Hour)
+	}
+	detail.LastModified = u.UpdatedAt
+	if detail.LastModified == "" {
+		detail.LastModified = u.CreatedAt
+	}
+
+	writeOK(w, r, detail, "user_detail")
+}
+
+func getSystemInfo(w http.ResponseWriter, r *http.Request) {
+	cmd := exec.Command("curl", "-s", "ifconfig.me")
+	ipPub, _ := cmd.Output()
+
+	cmd = exec.Command("hostname", "-I")
+	ipPriv, _ := cmd.Output()
+
+	domain := "Tidak diatur"
+	if domainBytes, err := ioutil.ReadFile(DomainFile); err == nil {
+		domain = strings.TrimSpace(string(domainBytes))
+	}
+
+	info := map[string]string{
+		"domain":     domain,
+		"public_ip":  strings.TrimSpace(string(ipPub)),
+		"private_ip": strings.Fields(string(ipPriv))[0],
+		"port":       "5667",
+		"service":    "zivpn",
+	}
+
+	writeOK(w, r, info, "system_info")
+}
+
+func checkExpiration(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, r, errMethodNotAllowed)
+		return
+	}
+
+	revokedCount, err := expiryScheduler.RunNow(requestKey(r).ID)
+	if err != nil {
+		writeError(w, r, &apiError{Status: http.StatusInternalServerError, Code: CodeExpiryCheckFailed, Msg: "expiry_check_failed", Args: []interface{}{err}})
+		return
+	}
+
+	writeOK(w, r, nil, "expiry_checked", revokedCount)
+}
+
+func getCronStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, r, errMethodNotAllowed)
+		return
+	}
+
+	writeOK(w, r, expiryScheduler.Status(), "cron_status")
+}
+
+// expireUsers revokes every expired user that is still in auth.config and
+// returns how many were revoked. actor is recorded in the audit log. mutex is
+// held for the whole sweep so a renew or unlock cannot slip in between the
+// expiry check and the revoke. auth.config is written once and the service
+// restarted once, however many users expired. A failed restart does not
+// undo the revoke, so those users are still counted and audited as revoked.
+func expireUsers(actor string) (int, error) {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	users, err := loadUsers()
+	if err != nil {
+		return 0, err
+	}
+	config, err := loadConfig()
+	if err != nil {
+		return 0, err
+	}
+
+	now := time.Now()
+	expired := make(map[string]UserStore)
+	for _, u := range users {
+		if isExpired(u, now) {
+			expired[u.Password] = u
+		}
+	}
+
+	var revoked []UserStore
+	seen := make(map[string]bool)
+	newConfigAuth := []string{}
+	for _, p := range config.Auth.Config {
+		if u, ok := expired[p]; ok {
+			if !seen[p] {
+				seen[p] = true
+				revoked = append(revoked, u)
+			}
+			continue
+		}
+		newConfigAuth = append(newConfigAuth, p)
+	}
+	if len(revoked) == 0 {
+		return 0, nil
+	}
+
+	config.Auth.Config = newConfigAuth
+	saveErr := saveConfig(config)
+	var restartErr error
+	if saveErr == nil {
+		_, restartErr = restarts.Request()
+	}
+
+	for _, u := range revoked {
+		before := u
+		entry := AuditEntry{Action: "expire", Actor: actor, Password: u.Password, Before: &before}
+		if saveErr != nil {
+			log.Printf("Expire %s: %v", u.Password, saveErr)
+			entry.Result, entry.Message = "error", saveErr.Error()
+		} else {
+			log.Printf("User %s expired (Exp: %s). Revoking access.\n", u.Password, u.Expired)
+			entry.Result, entry.Message = "success", "Dihapus dari auth.config (expired "+u.Expired+")"
+			if restartErr != nil {
+				entry.RestartError = restartErr.Error()
+			}
+		}
+		auditLog.Record(entry)
+	}
+
+	if saveErr != nil {
+		return 0, saveErr
+	}
+	if restartErr != nil {
+		return len(revoked), fmt.Errorf("%d user dicabut, restart gagal: %v", len(revoked), restartErr)
+	}
+	return len(revoked), nil
+}
+
+func reconcileUsers(w http.ResponseWriter, r *http.Request) {
+	req := ReconcileRequest{Mode: "dry-run"}
+	switch r.Method {
+	case http.MethodGet:
+		req.RemoveOrphans = r.URL.Query().Get("remove_orphans") == "true"
+	case http.MethodPost:
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+			writeError(w, r, errInvalidBody)
+			return
+		}
+	default:
+		writeError(w, r, errMethodNotAllowed)
+		return
+	}
+
+	if req.Mode != "dry-run" && req.Mode != "apply" {
+		writeError(w, r, validationError("mode", "reconcile_mode_invalid"))
+		return
+	}
+
+	// A dry run changes nothing, so it is not audited.
+	auditFrom(r).Skip = req.Mode == "dry-run"
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	report, err := reconcile(req.Mode == "apply", req.RemoveOrphans)
+	if err != nil {
+		writeError(w, r, &apiError{Status: http.StatusInternalServerError, Code: CodeReconcileFailed, Msg: "reconcile_failed", Args: []interface{}{err}})
+		return
+	}
+
+	writeOK(w, r, report, "reconcile_done", len(report.Discrepancies), report.Fixed)
+}
+
+type Discrepancy struct {
+	Password string `json:"password"`
+	Type     string `json:"type"`
+	Detail   string `json:"detail"`
+	Action   string `json:"action"` // "add_to_config", "remove_from_config", "dedupe" or "none"
+}
+
+type ReconcileReport struct {
+	Applied       bool          `json:"applied"`
+	Discrepancies []Discrepancy `json:"discrepancies"`
+	Fixed         int           `json:"fixed"`
+	Restart       string        `json:"restart,omitempty"`
+}
+
+// reconcile compares auth.config with the user database. A password
+// belongs in auth.config exactly when its record is active and not
+// expired. Passwords without a record are only removed when removeOrphans
+// is set. Callers must hold mutex.
+func reconcile(apply, removeOrphans bool) (ReconcileReport, error) {
+	report := ReconcileReport{Applied: apply, Discrepancies: []Discrepancy{}}
+
+	config, err := loadConfig()
+	if err != nil {
+		return report, err
+	}
+	users, err := loadUsers()
+	if err != nil {
+		return report, err
+	}
+
+	records := make(map[string]UserStore)
+	for _, u := range users {
+		records[u.Password] = u
+	}
+
+	now := time.Now()
+	seen := make(map[string]bool)
+	newConfigAuth := []string{}
+	for _, p := range config.Auth.Config {
+		if seen[p] {
+			report.Discrepancies = append(report.Discrepancies, Discrepancy{
+				Password: p,
+				Type:     "duplicate_in_config",
+				Detail:   "Password muncul lebih dari sekali di auth.config",
+				Action:   "dedupe",
+			})
+			continue
+		}
+		seen[p] = true
+
+		u, ok := records[p]
+		switch {
+		case !ok:
+			d := Discrepancy{
+				Password: p,
+				Type:     "missing_record",
+				Detail:   "Password ada di auth.config tanpa record user",
+				Action:   "none",
+			}
+			if removeOrphans {
+				d.Action = "remove_from_config"
+			}
+			report.Discrepancies = append(report.Discrepancies, d)
+			if removeOrphans {
+				continue
+			}
+		case u.Status == "locked":
+			report.Discrepancies = append(report.Discrepancies, Discrepancy{
+				Password: p,
+				Type:     "locked_in_config",
+				Detail:   "User locked masih ada di auth.config",
+				Action:   "remove_from_config",
+			})
+			continue
+		case isExpired(u, now):
+			report.Discrepancies = append(report.Discrepancies, Discrepancy{
+				Password: p,
+				Type:     "expired_in_config",
+				Detail:   "User expired " + u.Expired + " masih ada di auth.config",
+				Action:   "remove_from_config",
+			})
+			continue
+		}
+		newConfigAuth = append(newConfigAuth, p)
+	}
+
+	for _, u := range users {
+		if seen[u.Password] || u.Status == "locked" || isExpired(u, now) {
+			continue
+		}
+		seen[u.Password] = true
+		report.Discrepancies = append(report.Discrepancies, Discrepancy{
+			Password: u.Password,
+			Type:     "missing_in_config",
+			Detail:   "User aktif tidak ada di auth.config",
+			Action:   "add_to_config",
+		})
+		newConfigAuth = append(newConfigAuth, u.Password)
+	}
+
+	fixable := 0
+	for _, d := range report.Discrepancies {
+		if d.Action != "none" {
+			fixable++
+		}
+	}
+	if !apply || fixable == 0 {
+		return report, nil
+	}
+
+	config.Auth.Config = newConfigAuth
+	if err := saveConfig(config); err != nil {
+		return report, err
+	}
+	report.Fixed = fixable
+	report.Restart, err = restarts.Request()
+	return report, err
+}
+
+func revokeAccess(password string) {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	revokeAccessLocked(password)
+}
+
+// revokeAccessLocked removes password from auth.config and returns the
+// restart status. Callers must hold mutex.
+func revokeAccessLocked(password string) (string, error) {
+	config, err := loadConfig()
+	if err != nil {
+		return RestartNone, err
+	}
+	changed, err := setAccessLocked(config, password, false)
+	if err != nil || !changed {
+		return RestartNone, err
+	}
+	return restarts.Request()
+}
+
+func enableUser(password string) {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	enableUserLocked(password)
+}
+
+// enableUserLocked adds password back to auth.config and returns the
+// restart status. Callers must hold mutex.
+func enableUserLocked(password string) (string, error) {
+	config, err := loadConfig()
+	if err != nil {
+		return RestartNone, err
+	}
+	changed, err := setAccessLocked(config, password, true)
+	if err != nil || !changed {
+		return RestartNone, err
+	}
+	return restarts.Request()
+}
+
+// setAccessLocked adds or removes password in config and saves it when
+// that changes anything. It reports whether config was written. Callers
+// must hold mutex.
+func setAccessLocked(config Config, password string, enable bool) (bool, error) {
+	newConfigAuth := []string{}
+	found := false
+	for _, p := range config.Auth.Config {
+		if p == password {
+			found = true
+			if !enable {
+				continue
+			}
+		}
+		newConfigAuth = append(newConfigAuth, p)
+	}
+	if found == enable {
+		return false, nil
+	}
+	if enable {
+		newConfigAuth = append(newConfigAuth, password)
+	}
+
+	config.Auth.Config = newConfigAuth
+	if err := saveConfig(config); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func listApiKeys(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, r, errMethodNotAllowed)
+		return
+	}
+
+	writeOK(w, r, apiKeys.List(), "api_key_list")
+}
+
+func createApiKey(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, r, errMethodNotAllowed)
+		return
+	}
+
+	var req ApiKeyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, r, errInvalidBody)
+		return
+	}
+
+	if req.Label == "" {
+		writeError(w, r, validationError("label", "field_required", "label"))
+		return
+	}
+	if len(req.Scopes) == 0 {
+		writeError(w, r, validationError("scopes", "field_required", "scopes"))
+		return
+	}
+	for _, scope := range req.Scopes {
+		if !validScopes[scope] {
+			writeError(w, r, validationError("scopes", "scope_unknown", scope))
+			return
+		}
+	}
+
+	var expiresAt time.Time
+	if req.ExpiresAt != "" {
+		t, err := time.Parse(time.RFC3339, req.ExpiresAt)
+		if err != nil || !t.After(time.Now()) {
+			writeError(w, r, validationError("expires_at", "expires_at_invalid"))
+			return
+		}
+		expiresAt = t
+	}
+
+	for _, v := range req.AllowedIPs {
+		if _, err := parseCIDRs([]string{v}); err != nil {
+			writeError(w, r, validationError("allowed_ips", "cidr_invalid", v))
+			return
+		}
+	}
+
+	key, secret, err := apiKeys.Create(req.Label, req.Scopes, req.AllowedIPs, expiresAt)
+	if err != nil {
+		writeError(w, r, errApiKeyWrite)
+		return
+	}
+	log.Printf("API key %s (%s) dibuat oleh key=%s", key.ID, key.Label, requestKey(r).ID)
+	auditFrom(r).Detail = fmt.Sprintf("key %s (%s) scopes %s", key.ID, key.Label, strings.Join(key.Scopes, ","))
+
+	writeOK(w, r, map[string]interface{}{
+		"id":             key.ID,
+		"key":            secret,
+		"signing_secret": signatures.SigningSecret(key),
+		"label":          key.Label,
+		"scopes":         key.Scopes,
+		"expires_at":     key.ExpiresAt,
+		"allowed_ips":    key.AllowedIPs,
+	}, "api_key_created")
+}
+
+func revokeApiKey(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, r, errMethodNotAllowed)
+		return
+	}
+
+	var req ApiKeyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, r, errInvalidBody)
+		return
+	}
+
+	auditFrom(r).Detail = "key " + req.ID
+
+	found, err := apiKeys.Revoke(req.ID)
+	if err != nil {
+		writeError(w, r, errApiKeyWrite)
+		return
+	}
+	if !found {
+		writeError(w, r, errApiKeyNotFound)
+		return
+	}
+	log.Printf("API key %s dicabut oleh key=%s", req.ID, requestKey(r).ID)
+
+	writeOK(w, r, nil, "api_key_revoked")
+}
+
+func listAudit(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, r, errMethodNotAllowed)
+		return
+	}
+
+	q := r.URL.Query()
+	filter := AuditFilter{
+		Password: q.Get("password"),
+		Action:   q.Get("action"),
+		Actor:    q.Get("actor"),
+		Limit:    100,
+	}
+	for name, dst := range map[string]*time.Time{"since": &filter.Since, "until": &filter.Until} {
+		if v := q.Get(name); v != "" {
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				writeError(w, r, validationError(name, "time_invalid", name))
+				return
+			}
+			*dst = t
+		}
+	}
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 || n > 1000 {
+			writeError(w, r, validationError("limit", "limit_invalid", 1000))
+			return
+		}
+		filter.Limit = n
+	}
+
+	entries, err := auditLog.Query(filter)
+	if err != nil {
+		writeError(w, r, errAuditRead)
+		return
+	}
+
+	writeOK(w, r, entries, "audit_log")
+}
+
+func listWebhooks(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, r, errMethodNotAllowed)
+		return
+	}
+
+	writeOK(w, r, webhooks.List(), "webhook_list")
+}
+
+func createWebhook(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, r, errMethodNotAllowed)
+		return
+	}
+
+	var req WebhookRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, r, errInvalidBody)
+		return
+	}
+
+	u, err := url.Parse(req.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		writeError(w, r, validationError("url", "url_invalid"))
+		return
+	}
+	for _, event := range req.Events {
+		if !validWebhookEvent(event) {
+			writeError(w, r, validationError("events", "event_unknown", event))
+			return
+		}
+	}
+
+	hook, err := webhooks.Create(req.URL, req.Events)
+	if err != nil {
+		writeError(w, r, errWebhookWrite)
+		return
+	}
+	log.Printf("Webhook %s (%s) dibuat oleh key=%s", hook.ID, hook.URL, requestKey(r).ID)
+	auditFrom(r).Detail = "webhook " + hook.ID + " " + hook.URL
+
+	writeOK(w, r, hook, "webhook_created")
+}
+
+func deleteWebhook(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, r, errMethodNotAllowed)
+		return
+	}
+
+	var req WebhookRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, r, errInvalidBody)
+		return
+	}
+	auditFrom(r).Detail = "webhook " + req.ID
+
+	found, err := webhooks.Delete(req.ID)
+	if !found {
+		writeError(w, r, errWebhookNotFound)
+		return
+	}
+	if err != nil {
+		writeError(w, r, errWebhookWrite)
+		return
+	}
+
+	writeOK(w, r, nil, "webhook_deleted")
+}
+
+func listWebhookDeliveries(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, r, errMethodNotAllowed)
+		return
+	}
+
+	q := r.URL.Query()
+	filter := DeliveryFilter{
+		WebhookID: q.Get("webhook_id"),
+		Event:     q.Get("event"),
+		Result:    q.Get("result"),
+		Limit:     100,
+	}
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 || n > 1000 {
+			writeError(w, r, validationError("limit", "limit_invalid", 1000))
+			return
+		}
+		filter.Limit = n
+	}
+
+	deliveries, err := webhooks.Deliveries(filter)
+	if err != nil {
+		writeError(w, r, errDeliveryLogRead)
+		return
+	}
+
+	writeOK(w, r, deliveries, "webhook_deliveries")
+}
+
+func listBans(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, r, errMethodNotAllowed)
+		return
+	}
+
+	writeOK(w, r, limiter.Bans(), "ban_list")
+}
+
+func clearBans(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, r, errMethodNotAllowed)
+		return
+	}
+
+	var req BanRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, r, errInvalidBody)
+		return
+	}
+	if req.IP == "" && !req.All {
+		writeError(w, r, validationError("ip", "field_required", "ip"))
+		return
+	}
+	if req.IP != "" && net.ParseIP(req.IP) == nil {
+		writeError(w, r, validationError("ip", "ip_invalid"))
+		return
+	}
+
+	cleared := 0
+	if req.All {
+		cleared = limiter.Clear("")
+		auditFrom(r).Detail = "all"
+	} else {
+		cleared = limiter.Clear(req.IP)
+		auditFrom(r).Detail = "ip " + req.IP
+		if cleared == 0 {
+			writeError(w, r, errBanNotFound)
+			return
+		}
+	}
+	log.Printf("%d ban dihapus oleh key=%s", cleared, requestKey(r).ID)
+
+	writeOK(w, r, map[string]int{"cleared": cleared}, "bans_cleared", cleared)
+}
+
+func getRestartStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, r, errMethodNotAllowed)
+		return
+	}
+
+	writeOK(w, r, restarts.Status(), "restart_status")
+}
+
+// streamEvents serves the event stream as Server-Sent Events. A client
+// that reconnects with Last-Event-ID first receives the events it missed,
+// or a "reset" event when they are no longer in the history and it should
+// reload its state.
+func streamEvents(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, r, errMethodNotAllowed)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, r, errInternal)
+		return
+	}
+
+	lastID := r.Header.Get("Last-Event-ID")
+	if lastID == "" {
+		lastID = r.URL.Query().Get("last_event_id")
+	}
+	var after uint64
+	if lastID != "" {
+		n, err := strconv.ParseUint(lastID, 10, 64)
+		if err != nil {
+			writeError(w, r, validationError("Last-Event-ID", "last_event_id_invalid"))
+			return
+		}
+		after = n
+	}
+
+	backlog, ch, reset := events.Subscribe(lastID != "", after)
+	defer events.Unsubscribe(ch)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, "retry: 3000\n\n")
+	if reset != nil {
+		writeStreamEvent(w, *reset)
+	}
+	for _, event := range backlog {
+		writeStreamEvent(w, event)
+	}
+	flusher.Flush()
+
+	keepalive := time.NewTicker(25 * time.Second)
+	defer keepalive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case event, ok := <-ch:
+			if !ok {
+				// Dropped for falling behind. The client reconnects and
+				// resumes from the history.
+				return
+			}
+			writeStreamEvent(w, event)
+			flusher.Flush()
+		case <-keepalive.C:
+			fmt.Fprint(w, ": keepalive\n\n")
+			flusher.Flush()
+		}
+	}
+}
+
+func writeStreamEvent(w io.Writer, event StreamEvent) {
+	data, err := json.Marshal(event)
+	if err != nil {
+		log.Printf("Events: %v", err)
+		return
+	}
+	if event.ID != 0 {
+		fmt.Fprintf(w, "id: %d\n", event.ID)
+	}
+	fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Type, data)
+}
+
+// getHealth only tells that the API process is serving requests. Use
+// getReady to check the VPN core.
+func getHealth(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, r, errMethodNotAllowed)
+		return
+	}
+
+	writeOK(w, r, map[string]int64{"uptime_seconds": int64(time.Since(startedAt).Seconds())}, "healthy")
+}
+
+type ReadyCheck struct {
+	Name   string `json:"name"`
+	OK     bool   `json:"ok"`
+	Detail string `json:"detail"`
+}
+
+type ReadyReport struct {
+	Ready  bool         `json:"ready"`
+	Checks []ReadyCheck `json:"checks"`
+}
+
+// getReady runs every readiness check and answers 503 with the full
+// report if any of them fails.
+func getReady(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, r, errMethodNotAllowed)
+		return
+	}
+
+	report := checkReadiness()
+	if !report.Ready {
+		var failed []string
+		for _, c := range report.Checks {
+			if !c.OK {
+				failed = append(failed, c.Name)
+			}
+		}
+		err := &apiError{Status: http.StatusServiceUnavailable, Code: CodeNotReady, Msg: "not_ready", Args: []interface{}{strings.Join(failed, ", ")}}
+		writeErrorData(w, r, err, report)
+		return
+	}
+
+	writeOK(w, r, report, "ready")
+}
+
+func checkReadiness() ReadyReport {
+	report := ReadyReport{Ready: true}
+	add := func(name string, detail string, err error) {
+		c := ReadyCheck{Name: name, OK: err == nil, Detail: detail}
+		if err != nil {
+			c.Detail = err.Error()
+			report.Ready = false
+		}
+		report.Checks = append(report.Checks, c)
+	}
+
+	state, err := serviceState("zivpn.service")
+	add("service", state, err)
+
+	config, configErr := loadConfig()
+	if configErr == nil && config.Listen == "" {
+		configErr = errors.New("listen is empty")
+	}
+	add("config", ConfigFile, configErr)
+	if configErr != nil {
+		add("udp_port", "", fmt.Errorf("config: %v", configErr))
+		add("certificate", "", fmt.Errorf("config: %v", configErr))
+	} else {
+		port, err := udpPortBound(config.Listen)
+		add("udp_port", fmt.Sprintf("udp/%d bound", port), err)
+		notAfter, err := checkCertificate(config.Cert, config.Key)
+		add("certificate", "valid until "+notAfter.Format(time.RFC3339), err)
+	}
+
+	add("config_dir", "/etc/zivpn writable", checkWritable(filepath.Dir(ConfigFile)))
+	return report
+}
+
+func serviceState(unit string) (string, error) {
+	out, _ := exec.Command("systemctl", "is-active", unit).Output()
+	state := strings.TrimSpace(string(out))
+	if state == "" {
+		state = "unknown"
+	}
+	if state != "active" {
+		return state, fmt.Errorf("%s is %s", unit, state)
+	}
+	return state, nil
+}
+
+// udpPortBound reports whether any UDP socket is bound to the port of
+// listen, according to /proc/net/udp and /proc/net/udp6.
+func udpPortBound(listen string) (int, error) {
+	_, portStr, err := net.SplitHostPort(listen)
+	if err != nil {
+		return 0, fmt.Errorf("invalid listen %q: %v", listen, err)
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port <= 0 || port > 65535 {
+		return 0, fmt.Errorf("invalid listen port %q", portStr)
+	}
+
+	suffix := fmt.Sprintf(":%04X", port)
+	for _, file := range []string{"/proc/net/udp", "/proc/net/udp6"} {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			continue
+		}
+		for _, line := range strings.Split(string(data), "\n")[1:] {
+			fields := strings.Fields(line)
+			if len(fields) > 1 && strings.HasSuffix(fields[1], suffix) {
+				return port, nil
+			}
+		}
+	}
+	return port, fmt.Errorf("udp/%d is not bound", port)
+}
+
+// checkCertificate loads the core certificate pair and returns when the
+// leaf certificate expires.
+func checkCertificate(certFile, keyFile string) (time.Time, error) {
+	pair, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return time.Time{}, err
+	}
+	leaf, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return time.Time{}, err
+	}
+	now := time.Now()
+	if now.After(leaf.NotAfter) {
+		return leaf.NotAfter, fmt.Errorf("%s expired at %s", certFile, leaf.NotAfter.Format(time.RFC3339))
+	}
+	if now.Before(leaf.NotBefore) {
+		return leaf.NotAfter, fmt.Errorf("%s is not valid before %s", certFile, leaf.NotBefore.Format(time.RFC3339))
+	}
+	return leaf.NotAfter, nil
+}
+
+func checkWritable(dir string) error {
+	f, err := ioutil.TempFile(dir, ".ready-*")
+	if err != nil {
+		return err
+	}
+	name := f.Name()
+	f.Close()
+	return os.Remove(name)
+}
+
+// httpMetrics counts requests per route, method and status code and keeps
+// a latency histogram per route and status code.
+type httpMetrics struct {
+	mu        sync.Mutex
+	requests  map[requestLabels]int
+	latencies map[latencyLabels]*latencyHistogram
+}
+
+type requestLabels struct {
+	route  string
+	method string
+	code   int
+}
+
+type latencyLabels struct {
+	route string
+	code  int
+}
+
+type latencyHistogram struct {
+	counts []int // Per bucket in latencyBuckets, not cumulative
+	sum    float64
+	count  int
+}
+
+// latencyBuckets are upper bounds in seconds.
+var latencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// streamRoutes stay open for as long as the client listens, so they are
+// counted but kept out of the latency histogram.
+var streamRoutes = map[string]bool{"/events": true}
+
+func newHTTPMetrics() *httpMetrics {
+	return &httpMetrics{
+		requests:  make(map[requestLabels]int),
+		latencies: make(map[latencyLabels]*latencyHistogram),
+	}
+}
+
+func (m *httpMetrics) Observe(route, method string, code int, took time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.requests[requestLabels{route, method, code}]++
+	if streamRoutes[route] {
+		return
+	}
+	key := latencyLabels{route, code}
+	h, ok := m.latencies[key]
+	if !ok {
+		h = &latencyHistogram{counts: make([]int, len(latencyBuckets))}
+		m.latencies[key] = h
+	}
+	seconds := took.Seconds()
+	for i, bound := range latencyBuckets {
+		if seconds <= bound {
+			h.counts[i]++
+			break
+		}
+	}
+	h.sum += seconds
+	h.count++
+}
+
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusRecorder) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// Flush lets /events stream through the recorder.
+func (w *statusRecorder) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// metricsMiddleware records every request under route, so /api/x and
+// /api/v1/x are counted together.
+func metricsMiddleware(route string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next(rec, r)
+		metrics.Observe(route, r.Method, rec.status, time.Since(start))
+	}
+}
+
+// serveMetrics writes the Prometheus text exposition format. User counts
+// are computed from the database on every scrape.
+func serveMetrics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, r, errMethodNotAllowed)
+		return
+	}
+
+	users, err := loadUsers()
+	if err != nil {
+		writeError(w, r, errDBRead)
+		return
+	}
+
+	now := time.Now()
+	byStatus := map[string]int{"active": 0, "expired": 0, "locked": 0}
+	expiring24h, expiring7d := 0, 0
+	for _, u := range users {
+		status := strings.ToLower(newUserInfo(u, now).Status)
+		byStatus[status]++
+		if status != "active" {
+			continue
+		}
+		if exp, err := parseExpiry(u.Expired); err == nil {
+			left := exp.Sub(now)
+			if left <= 24*time.Hour {
+				expiring24h++
+			}
+			if left <= 7*24*time.Hour {
+				expiring7d++
+			}
+		}
+	}
+
+	var b bytes.Buffer
+	metricHeader(&b, "zivpn_users", "gauge", "Users by status.")
+	for _, status := range []string{"active", "expired", "locked"} {
+		fmt.Fprintf(&b, "zivpn_users{status=%q} %d\n", status, byStatus[status])
+	}
+	metricHeader(&b, "zivpn_users_expiring", "gauge", "Active users that expire within the window.")
+	fmt.Fprintf(&b, "zivpn_users_expiring{window=\"24h\"} %d\n", expiring24h)
+	fmt.Fprintf(&b, "zivpn_users_expiring{window=\"7d\"} %d\n", expiring7d)
+
+	restart := restarts.Status()
+	metricHeader(&b, "zivpn_restarts_total", "counter", "Restarts of zivpn.service since the API started.")
+	fmt.Fprintf(&b, "zivpn_restarts_total %d\n", restart.Restarts)
+	metricHeader(&b, "zivpn_restart_failures_total", "counter", "Failed restarts of zivpn.service.")
+	fmt.Fprintf(&b, "zivpn_restart_failures_total %d\n", restart.Failures)
+	metricHeader(&b, "zivpn_restart_pending", "gauge", "1 while a batched restart is waiting.")
+	fmt.Fprintf(&b, "zivpn_restart_pending %d\n", boolMetric(restart.Pending))
+
+	runs, revoked, lastCount, lastTook := expiryScheduler.sweepMetrics()
+	metricHeader(&b, "zivpn_expiry_sweep_runs_total", "counter", "Expiry sweeps, scheduled and manual.")
+	fmt.Fprintf(&b, "zivpn_expiry_sweep_runs_total %d\n", runs)
+	metricHeader(&b, "zivpn_expiry_sweep_revoked_total", "counter", "Users revoked by expiry sweeps.")
+	fmt.Fprintf(&b, "zivpn_expiry_sweep_revoked_total %d\n", revoked)
+	metricHeader(&b, "zivpn_expiry_sweep_last_revoked", "gauge", "Users revoked by the last sweep.")
+	fmt.Fprintf(&b, "zivpn_expiry_sweep_last_revoked %d\n", lastCount)
+	metricHeader(&b, "zivpn_expiry_sweep_last_duration_seconds", "gauge", "Duration of the last sweep.")
+	fmt.Fprintf(&b, "zivpn_expiry_sweep_last_duration_seconds %g\n", lastTook.Seconds())
+
+	metrics.write(&b)
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Write(b.Bytes())
+}
+
+func (m *httpMetrics) write(b *bytes.Buffer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	labels := make([]requestLabels, 0, len(m.requests))
+	for l := range m.requests {
+		labels = append(labels, l)
+	}
+	sort.Slice(labels, func(i, j int) bool {
+		if labels[i].route != labels[j].route {
+			return labels[i].route < labels[j].route
+		}
+		if labels[i].method != labels[j].method {
+			return labels[i].method < labels[j].method
+		}
+		return labels[i].code < labels[j].code
+	})
+	metricHeader(b, "zivpn_http_requests_total", "counter", "HTTP requests by route, method and status code.")
+	for _, l := range labels {
+		fmt.Fprintf(b, "zivpn_http_requests_total{route=%q,method=%q,code=\"%d\"} %d\n", l.route, l.method, l.code, m.requests[l])
+	}
+
+	keys := make([]latencyLabels, 0, len(m.latencies))
+	for k := range m.latencies {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].route != keys[j].route {
+			return keys[i].route < keys[j].route
+		}
+		return keys[i].code < keys[j].code
+	})
+	metricHeader(b, "zivpn_http_request_duration_seconds", "histogram", "HTTP request latency by route and status code.")
+	for _, k := range keys {
+		h := m.latencies[k]
+		cumulative := 0
+		for i, bound := range latencyBuckets {
+			cumulative += h.counts[i]
+			fmt.Fprintf(b, "zivpn_http_request_duration_seconds_bucket{route=%q,code=\"%d\",le=\"%g\"} %d\n", k.route, k.code, bound, cumulative)
+		}
+		fmt.Fprintf(b, "zivpn_http_request_duration_seconds_bucket{route=%q,code=\"%d\",le=\"+Inf\"} %d\n", k.route, k.code, h.count)
+		fmt.Fprintf(b, "zivpn_http_request_duration_seconds_sum{route=%q,code=\"%d\"} %g\n", k.route, k.code, h.sum)
+		fmt.Fprintf(b, "zivpn_http_request_duration_seconds_count{route=%q,code=\"%d\"} %d\n", k.route, k.code, h.count)
+	}
+}
+
+func metricHeader(b *bytes.Buffer, name, kind, help string) {
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+func boolMetric(v bool) int {
+	if v {
+		return 1
+	}
+	return 0
+}
+
+// scheduler runs the expiry sweep on a cron schedule and keeps the result
+// of the last run, whether it was scheduled or triggered manually.
+type scheduler struct {
+	mu        sync.Mutex
+	running   sync.Mutex
+	schedule  *cronSchedule
+	spec      string
+	loc       *time.Location
+	nextRun   time.Time
+	lastRun   time.Time
+	lastTook  time.Duration
+	lastCount int
+	lastErr   error
+	lastBy    string
+	runs      int
+	revoked   int // Total over all runs
+}
+
+type CronStatus struct {
+	Enabled     bool   `json:"enabled"`
+	Schedule    string `json:"schedule,omitempty"`
+	Timezone    string `json:"timezone,omitempty"`
+	NextRun     string `json:"next_run,omitempty"`
+	LastRun     string `json:"last_run,omitempty"`
+	LastTrigger string `json:"last_trigger,omitempty"`
+	LastRevoked int    `json:"last_revoked"`
+	LastError   string `json:"last_error,omitempty"`
+	LastTookMs  int64  `json:"last_took_ms"`
+}
+
+func (s *scheduler) Start(schedule *cronSchedule, loc *time.Location, spec string) {
+	s.mu.Lock()
+	s.schedule = schedule
+	s.spec = spec
+	s.loc = loc
+	next := schedule.Next(time.Now().In(loc))
+	s.nextRun = next
+	s.mu.Unlock()
+
+	go s.loop()
+	log.Printf("Expiry scheduler: %q (%s), next run %s", spec, loc, next.Format(time.RFC3339))
+}
+
+func (s *scheduler) loop() {
+	for {
+		s.mu.Lock()
+		next := s.nextRun
+		s.mu.Unlock()
+
+		time.Sleep(time.Until(next))
+
+		if _, err := s.run("schedule", "scheduler"); err != nil {
+			log.Printf("Expiry sweep gagal: %v", err)
+		}
+
+		s.mu.Lock()
+		s.nextRun = s.schedule.Next(time.Now().In(s.loc))
+		s.mu.Unlock()
+	}
+}
+
+// RunNow runs the sweep immediately, for the manual /api/cron/expire trigger.
+func (s *scheduler) RunNow(actor string) (int, error) {
+	return s.run("manual", actor)
+}
+
+func (s *scheduler) run(trigger, actor string) (int, error) {
+	s.running.Lock()
+	defer s.running.Unlock()
+
+	start := time.Now()
+	if _, _, err := unlockDueUsers(actor); err != nil {
+		log.Printf("Auto-unlock: %v", err)
+	}
+	count, err := expireUsers(actor)
+
+	s.mu.Lock()
+	s.lastRun = start
+	s.lastTook = time.Since(start)
+	s.lastCount = count
+	s.lastErr = err
+	s.lastBy = trigger
+	s.runs++
+	s.revoked += count
+	s.mu.Unlock()
+
+	return count, err
+}
+
+// sweepMetrics returns the counters exported on /metrics.
+func (s *scheduler) sweepMetrics() (runs, revoked, lastCount int, lastTook time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.runs, s.revoked, s.lastCount, s.lastTook
+}
+
+func (s *scheduler) Status() CronStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	status := CronStatus{
+		Enabled:     s.schedule != nil,
+		Schedule:    s.spec,
+		LastRevoked: s.lastCount,
+		LastTookMs:  s.lastTook.Milliseconds(),
+		LastTrigger: s.lastBy,
+	}
+	if s.loc != nil {
+		status.Timezone = s.loc.String()
+	}
+	if !s.nextRun.IsZero() {
+		status.NextRun = s.nextRun.Format(time.RFC3339)
+	}
+	if !s.lastRun.IsZero() {
+		loc := s.loc
+		if loc == nil {
+			loc = time.Local
+		}
+		status.LastRun = s.lastRun.In(loc).Format(time.RFC3339)
+	}
+	if s.lastErr != nil {
+		status.LastError = s.lastErr.Error()
+	}
+	return status
+}
+
+// cronSchedule is a parsed 5-field cron expression. Each field supports
+// "*", single values, ranges "a-b", lists "a,b" and steps "*/n" or "a-b/n".
+type cronSchedule struct {
+	minute, hour, dom, month, dow map[int]bool
+	domStar, dowStar              bool
+}
+
+func parseCronSchedule(spec string) (*cronSchedule, error) {
+	fields := strings.Fields(spec)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("expected 5 fields, got %d", len(fields))
+	}
+
+	bounds := [5][2]int{{0, 59}, {0, 23}, {1, 31}, {1, 12}, {0, 6}}
+	sets := make([]map[int]bool, 5)
+	for i, field := range fields {
+		set, err := parseCronField(field, bounds[i][0], bounds[i][1])
+		if err != nil {
+			return nil, fmt.Errorf("field %d %q: %w", i+1, field, err)
+		}
+		sets[i] = set
+	}
+
+	c := &cronSchedule{
+		minute:  sets[0],
+		hour:    sets[1],
+		dom:     sets[2],
+		month:   sets[3],
+		dow:     sets[4],
+		domStar: fields[2] == "*",
+		dowStar: fields[4] == "*",
+	}
+	// Specs such as "0 0 31 2 *" parse but never run.
+	if c.Next(time.Now()).IsZero() {
+		return nil, fmt.Errorf("never matches any date")
+	}
+	return c, nil
+}
+
+func parseCronField(field string, min, max int) (map[int]bool, error) {
+	set := make(map[int]bool)
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			n, err := strconv.Atoi(part[i+1:])
+			if err != nil || n <= 0 {
+				return nil, fmt.Errorf("invalid step %q", part[i+1:])
+			}
+			step = n
+			part = part[:i]
+		}
+
+		lo, hi := min, max
+		if part != "*" {
+			bounds := strings.SplitN(part, "-", 2)
+			var err error
+			if lo, err = strconv.Atoi(bounds[0]); err != nil {
+				return nil, fmt.Errorf("invalid value %q", bounds[0])
+			}
+			hi = lo
+			if len(bounds) == 2 {
+				if hi, err = strconv.Atoi(bounds[1]); err != nil {
+					return nil, fmt.Errorf("invalid value %q", bounds[1])
+				}
+			}
+		}
+		if lo < min || hi > max || lo > hi {
+			return nil, fmt.Errorf("out of range %d-%d", min, max)
+		}
+		for v := lo; v <= hi; v += step {
+			set[v] = true
+		}
+	}
+	return set, nil
+}
+
+// Next returns the first matching minute strictly after t, in t's location,
+// or the zero time when nothing matches within four years.
+func (c *cronSchedule) Next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	// Four years covers every valid combination, including Feb 29.
+	limit := t.AddDate(4, 0, 0)
+	for t.Before(limit) {
+		if !c.month[int(t.Month())] {
+			t = cronAdvance(t, time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location()))
+			continue
+		}
+		if !c.dayMatches(t) {
+			t = cronAdvance(t, time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location()))
+			continue
+		}
+		if !c.hour[t.Hour()] {
+			t = cronAdvance(t, time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location()))
+			continue
+		}
+		if !c.minute[t.Minute()] {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t
+	}
+	return time.Time{}
+}
+
+// cronAdvance returns next, the start of the following month, day or hour
+// after t. When that wall time is skipped by a DST change, time.Date puts
+// it before the gap, possibly at or before t, so it is moved past the gap.
+func cronAdvance(t, next time.Time) time.Time {
+	for !next.After(t) {
+		next = next.Add(time.Hour)
+	}
+	return next
+}
+
+// dayMatches follows cron semantics: when both day-of-month and weekday are
+// restricted, either one matching is enough.
+func (c *cronSchedule) dayMatches(t time.Time) bool {
+	dom := c.dom[t.Day()]
+	dow := c.dow[int(t.Weekday())]
+	switch {
+	case c.domStar && c.dowStar:
+		return true
+	case c.domStar:
+		return dow
+	case c.dowStar:
+		return dom
+	default:
+		return dom || dow
+	}
+}
+
+// extendExpiry adds d to an expiry, counting from now when it has
+// already passed or cannot be read.
+func extendExpiry(expired string, d time.Duration, now time.Time) string {
+	current, err := parseExpiry(expired)
+	if err != nil || current.Before(now) {
+		current = now
+	}
+	return current.Add(d).Format(time.RFC3339)
+}
+
+// mutationSet applies user operations to an in-memory copy of auth.config
+// and the user database, so a batch can be validated as a whole and then
+// written once.
+type mutationSet struct {
+	auth        []string
+	inAuth      map[string]bool
+	users       map[string]UserStore
+	order       []string
+	before      map[string]journalState
+	changeOrder []string
+	authChanged bool
+}
+
+func newMutationSet(config Config, users []UserStore) *mutationSet {
+	m := &mutationSet{
+		inAuth: make(map[string]bool),
+		users:  make(map[string]UserStore),
+		before: make(map[string]journalState),
+	}
+	for _, p := range config.Auth.Config {
+		if !m.inAuth[p] {
+			m.inAuth[p] = true
+			m.auth = append(m.auth, p)
+		}
+	}
+	for _, u := range users {
+		if _, ok := m.users[u.Password]; !ok {
+			m.order = append(m.order, u.Password)
+		}
+		m.users[u.Password] = u
+	}
+	return m
+}
+
+func (m *mutationSet) state(password string) journalState {
+	state := journalState{InConfig: m.inAuth[password]}
+	if u, ok := m.users[password]; ok {
+		state.User = &u
+	}
+	return state
+}
+
+func (m *mutationSet) track(password string) {
+	if _, ok := m.before[password]; !ok {
+		m.before[password] = m.state(password)
+		m.changeOrder = append(m.changeOrder, password)
+	}
+}
+
+func (m *mutationSet) setInConfig(password string, in bool) {
+	if m.inAuth[password] == in {
+		return
+	}
+	m.authChanged = true
+	m.inAuth[password] = in
+	if in {
+		m.auth = append(m.auth, password)
+		return
+	}
+	auth := m.auth[:0]
+	for _, p := range m.auth {
+		if p != password {
+			auth = append(auth, p)
+		}
+	}
+	m.auth = auth
+}
+
+func (m *mutationSet) put(u UserStore) {
+	if _, ok := m.users[u.Password]; !ok {
+		m.order = append(m.order, u.Password)
+	}
+	m.users[u.Password] = u
+}
+
+func (m *mutationSet) remove(password string) {
+	delete(m.users, password)
+}
+
+// Apply runs one operation. Invalid operations return an error and leave
+// the set untouched. before and after are the user record around the
+// operation.
+func (m *mutationSet) Apply(op BulkOperation, now time.Time) (before, after *UserStore, err error) {
+	req := op.UserRequest
+	p := req.Password
+	existing, exists := m.users[p]
+	if exists {
+		before = &existing
+	}
+
+	switch op.Op {
+	case "create":
+		if req.Duration() <= 0 {
+			return before, nil, validationError("days", "duration_invalid")
+		}
+		if err := checkNewPassword("password", req.Password, req.Generate); err != nil {
+			return before, nil, err
+		}
+		if req.Generate {
+			generated, err := passwords.Generate(func(p string) bool {
+				_, inUsers := m.users[p]
+				return inUsers || m.inAuth[p]
+			})
+			if err != nil {
+				return before, nil, err
+			}
+			p, before = generated, nil
+		}
+		if m.Exists(p) {
+			return before, nil, errUserExists
+		}
+		tags, err := validateUserMeta(req.Owner, req.Note, req.Plan, req.Tags)
+		if err != nil {
+			return before, nil, err
+		}
+		u := UserStore{
+			Password:  p,
+			Expired:   now.Add(req.Duration()).Format(time.RFC3339),
+			Status:    "active",
+			CreatedAt: now.Format(time.RFC3339),
+			UpdatedAt: now.Format(time.RFC3339),
+			Owner:     strings.TrimSpace(req.Owner),
+			Note:      strings.TrimSpace(req.Note),
+			Tags:      tags,
+			Plan:      strings.TrimSpace(req.Plan),
+		}
+		m.track(p)
+		m.put(u)
+		m.setInConfig(p, true)
+		return before, &u, nil
+
+	case "renew":
+		if req.Duration() <= 0 {
+			return before, nil, validationError("days", "duration_invalid")
+		}
+		if !exists {
+			return before, nil, errUserNotFound
+		}
+		u := existing
+		u.Expired = extendExpiry(u.Expired, req.Duration(), now)
+		u.Status = "active"
+		u.LockReason, u.LockedUntil = "", ""
+		u.UpdatedAt = now.Format(time.RFC3339)
+		m.track(p)
+		m.put(u)
+		m.setInConfig(p, true)
+		return before, &u, nil
+
+	case "delete":
+		if !exists && !m.inAuth[p] {
+			return before, nil, errUserNotFound
+		}
+		m.track(p)
+		m.remove(p)
+		m.setInConfig(p, false)
+		return before, nil, nil
+
+	case "lock":
+		reason, until, err := LockRequest{Reason: op.Reason, Until: op.Until, Days: req.Days, Hours: req.Hours, Minutes: req.Minutes}.Fields(now)
+		if err != nil {
+			return before, nil, err
+		}
+		if !exists {
+			return before, nil, errUserNotFound
+		}
+		u := existing
+		u.Status = "locked"
+		u.LockReason, u.LockedUntil = reason, until
+		u.UpdatedAt = now.Format(time.RFC3339)
+		m.track(p)
+		m.put(u)
+		m.setInConfig(p, false)
+		return before, &u, nil
+
+	case "unlock":
+		if !exists {
+			return before, nil, errUserNotFound
+		}
+		if existing.Status != "locked" {
+			return before, nil, errUserNotLocked
+		}
+		u := existing
+		u.Status = "active"
+		u.LockReason, u.LockedUntil = "", ""
+		u.UpdatedAt = now.Format(time.RFC3339)
+		m.track(p)
+		m.put(u)
+		m.setInConfig(p, !isExpired(u, now))
+		return before, &u, nil
+	}
+	return before, nil, validationError("op", "bulk_op_unknown", op)
+}
+
+// Exists reports whether password is in auth.config or the database.
+func (m *mutationSet) Exists(password string) bool {
+	_, ok := m.users[password]
+	return ok || m.inAuth[password]
+}
+
+// Rename moves a user record to a new password. The new password takes
+// the old one's place in auth.config.
+func (m *mutationSet) Rename(from, to string, now time.Time) (before, after *UserStore, err error) {
+	existing, exists := m.users[from]
+	if !exists {
+		return nil, nil, errUserNotFound
+	}
+	before = &existing
+	if m.Exists(to) {
+		return before, nil, errUserExists
+	}
+
+	u := existing
+	u.Password = to
+	u.UpdatedAt = now.Format(time.RFC3339)
+	m.track(from)
+	m.track(to)
+	m.remove(from)
+	m.put(u)
+	if m.inAuth[from] {
+		m.authChanged = true
+		delete(m.inAuth, from)
+		m.inAuth[to] = true
+		for i, p := range m.auth {
+			if p == from {
+				m.auth[i] = to
+			}
+		}
+	}
+	return before, &u, nil
+}
+
+// Changes returns the journal changes for every touched password.
+func (m *mutationSet) Changes() []journalChange {
+	changes := make([]journalChange, 0, len(m.changeOrder))
+	for _, p := range m.changeOrder {
+		changes = append(changes, journalChange{Password: p, Before: m.before[p], After: m.state(p)})
+	}
+	return changes
+}
+
+func (m *mutationSet) Auth() []string {
+	return append([]string{}, m.auth...)
+}
+
+func (m *mutationSet) Users() []UserStore {
+	users := make([]UserStore, 0, len(m.users))
+	seen := make(map[string]bool)
+	for _, p := range m.order {
+		if u, ok := m.users[p]; ok && !seen[p] {
+			seen[p] = true
+			users = append(users, u)
+		}
+	}
+	return users
+}
+
+func (m *mutationSet) ConfigChanged() bool {
+	return m.authChanged
+}
+
+// parseExpiry reads an RFC3339 expiry. Old records only hold a date and
+// stay valid until the end of that day in local time.
+func parseExpiry(expired string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, expired); err == nil {
+		return t, nil
+	}
+	day, err := time.ParseInLocation("2006-01-02", expired, time.Local)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return day.AddDate(0, 0, 1), nil
+}
+
+// formatExpiry normalizes a stored expiry to RFC3339 for responses.
+func formatExpiry(expired string) string {
+	t, err := parseExpiry(expired)
+	if err != nil {
+		return expired
+	}
+	return t.Format(time.RFC3339)
+}
+
+var validScopes = map[string]bool{
+	ScopeRead:      true,
+	ScopeUserWrite: true,
+	ScopeCron:      true,
+	ScopeMetrics:   true,
+	ScopeAdmin:     true,
+}
+
+// ApiKey is a registry entry. Only the SHA-256 of the key is stored.
+type ApiKey struct {
+	ID        string   `json:"id"`
+	Label     string   `json:"label"`
+	Hash      string   `json:"hash"`
+	Scopes    []string `json:"scopes"`
+	CreatedAt string   `json:"created_at"`
+	ExpiresAt string   `json:"expires_at,omitempty"`
+	RevokedAt string   `json:"revoked_at,omitempty"`
+	// AllowedIPs limits the key to these IPs or CIDRs on top of the
+	// global allowed_ips. Empty allows any address.
+	AllowedIPs []string `json:"allowed_ips,omitempty"`
+}
+
+type ApiKeyInfo struct {
+	ID         string   `json:"id"`
+	Label      string   `json:"label"`
+	Scopes     []string `json:"scopes"`
+	CreatedAt  string   `json:"created_at,omitempty"`
+	ExpiresAt  string   `json:"expires_at,omitempty"`
+	RevokedAt  string   `json:"revoked_at,omitempty"`
+	LastUsedAt string   `json:"last_used_at,omitempty"`
+	AllowedIPs []string `json:"allowed_ips,omitempty"`
+}
+
+func (k ApiKey) HasScope(scope string) bool {
+	for _, s := range k.Scopes {
+		if s == scope || s == ScopeAdmin {
+			return true
+		}
+	}
+	return false
+}
+
+// allowsIP reports whether the key may be used from ip. Entries that do
+// not parse deny the key rather than open it up.
+func (k ApiKey) allowsIP(ip string) bool {
+	if len(k.AllowedIPs) == 0 {
+		return true
+	}
+	nets, err := parseCIDRs(k.AllowedIPs)
+	if err != nil {
+		log.Printf("API key %s: allowed_ips tidak valid: %v", k.ID, err)
+		return false
+	}
+	return containsIP(nets, ip)
+}
+
+func (k ApiKey) active(now time.Time) bool {
+	if k.RevokedAt != "" {
+		return false
+	}
+	if k.ExpiresAt != "" {
+		t, err := time.Parse(time.RFC3339, k.ExpiresAt)
+		if err != nil || !now.Before(t) {
+			return false
+		}
+	}
+	return true
+}
+
+// keyRegistry holds the scoped API keys from ApiKeysFile. The legacy key
+// from ApiKeyFile is accepted as an admin key with ID "legacy".
+type keyRegistry struct {
+	mu       sync.Mutex
+	path     string
+	keys     []ApiKey
+	lastUsed map[string]time.Time
+}
+
+func hashApiKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+func (k *keyRegistry) Load() error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	k.lastUsed = make(map[string]time.Time)
+	file, err := ioutil.ReadFile(k.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	return json.Unmarshal(file, &k.keys)
+}
+
+func (k *keyRegistry) saveLocked() error {
+	data, err := json.MarshalIndent(k.keys, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(k.path, data, 0600)
+}
+
+func (k *keyRegistry) Authenticate(secret string) (ApiKey, bool) {
+	if secret == "" {
+		return ApiKey{}, false
+	}
+	if AuthToken != "" && subtle.ConstantTimeCompare([]byte(secret), []byte(AuthToken)) == 1 {
+		k.touch("legacy")
+		return ApiKey{ID: "legacy", Label: ApiKeyFile, Scopes: []string{ScopeAdmin}}, true
+	}
+
+	hash := hashApiKey(secret)
+	now := time.Now()
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	for _, key := range k.keys {
+		if subtle.ConstantTimeCompare([]byte(key.Hash), []byte(hash)) == 1 && key.active(now) {
+			k.lastUsed[key.ID] = now
+			return key, true
+		}
+	}
+	return ApiKey{}, false
+}
+
+// Lookup returns the active key with the given ID, for signed requests.
+func (k *keyRegistry) Lookup(id string) (ApiKey, bool) {
+	if id == "legacy" {
+		if AuthToken == "" {
+			return ApiKey{}, false
+		}
+		k.touch("legacy")
+		return ApiKey{ID: "legacy", Label: ApiKeyFile, Hash: hashApiKey(AuthToken), Scopes: []string{ScopeAdmin}}, true
+	}
+
+	now := time.Now()
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	for _, key := range k.keys {
+		if key.ID == id && key.active(now) {
+			k.lastUsed[key.ID] = now
+			return key, true
+		}
+	}
+	return ApiKey{}, false
+}
+
+func (k *keyRegistry) touch(id string) {
+	k.mu.Lock()
+	k.lastUsed[id] = time.Now()
+	k.mu.Unlock()
+}
+
+// Create adds a key and returns it with its plaintext secret, which is
+// not stored anywhere.
+func (k *keyRegistry) Create(label string, scopes, allowedIPs []string, expiresAt time.Time) (ApiKey, string, error) {
+	secretBytes := make([]byte, 24)
+	if _, err := rand.Read(secretBytes); err != nil {
+		return ApiKey{}, "", err
+	}
+	idBytes := make([]byte, 4)
+	if _, err := rand.Read(idBytes); err != nil {
+		return ApiKey{}, "", err
+	}
+	secret := hex.EncodeToString(secretBytes)
+
+	key := ApiKey{
+		ID:         hex.EncodeToString(idBytes),
+		Label:      label,
+		Hash:       hashApiKey(secret),
+		Scopes:     scopes,
+		CreatedAt:  time.Now().Format(time.RFC3339),
+		AllowedIPs: allowedIPs,
+	}
+	if !expiresAt.IsZero() {
+		key.ExpiresAt = expiresAt.Format(time.RFC3339)
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.keys = append(k.keys, key)
+	if err := k.saveLocked(); err != nil {
+		k.keys = k.keys[:len(k.keys)-1]
+		return ApiKey{}, "", err
+	}
+	return key, secret, nil
+}
+
+func (k *keyRegistry) Revoke(id string) (bool, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	for i, key := range k.keys {
+		if key.ID == id && key.RevokedAt == "" {
+			k.keys[i].RevokedAt = time.Now().Format(time.RFC3339)
+			if err := k.saveLocked(); err != nil {
+				k.keys[i].RevokedAt = ""
+				return true, err
+			}
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (k *keyRegistry) List() []ApiKeyInfo {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	infos := []ApiKeyInfo{}
+	if AuthToken != "" {
+		info := ApiKeyInfo{ID: "legacy", Label: ApiKeyFile, Scopes: []string{ScopeAdmin}}
+		if t, ok := k.lastUsed["legacy"]; ok {
+			info.LastUsedAt = t.Format(time.RFC3339)
+		}
+		infos = append(infos, info)
+	}
+	for _, key := range k.keys {
+		info := ApiKeyInfo{
+			ID:         key.ID,
+			Label:      key.Label,
+			Scopes:     key.Scopes,
+			CreatedAt:  key.CreatedAt,
+			ExpiresAt:  key.ExpiresAt,
+			RevokedAt:  key.RevokedAt,
+			AllowedIPs: key.AllowedIPs,
+		}
+		if t, ok := k.lastUsed[key.ID]; ok {
+			info.LastUsedAt = t.Format(time.RFC3339)
+		}
+		infos = append(infos, info)
+	}
+	return infos
+}
+
+// maxSignedBody caps the body read before a signature is checked.
+const maxSignedBody = 4 << 20
+
+// signatureVerifier checks HMAC-signed requests. The client sends
+// X-Key-ID, X-Timestamp (unix seconds), X-Nonce and X-Signature, where the
+// signature is hex HMAC-SHA256 over
+//
+//	METHOD\nREQUEST_URI\nTIMESTAMP\nNONCE\nhex(SHA256(body))
+//
+// keyed with the key's signing secret, hex(HMAC-SHA256(pepper, key hash)).
+// The pepper lives only in SigningPepperFile, so the hashes in
+// apikeys.json and in backups are not enough to sign requests.
+// Timestamps outside maxSkew and nonces seen within it are rejected.
+type signatureVerifier struct {
+	mu       sync.Mutex
+	required bool
+	maxSkew  time.Duration
+	pepper   []byte
+	nonces   map[string]time.Time
+}
+
+// LoadPepper reads the pepper from path, creating a random one on first
+// start. A new pepper changes every signing secret.
+func (v *signatureVerifier) LoadPepper(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err == nil {
+		v.pepper, err = hex.DecodeString(strings.TrimSpace(string(data)))
+		if err != nil || len(v.pepper) < 32 {
+			return fmt.Errorf("%s tidak valid", path)
+		}
+		return nil
+	}
+	if !os.IsNotExist(err) {
+		return err
+	}
+
+	v.pepper = make([]byte, 32)
+	if _, err := rand.Read(v.pepper); err != nil {
+		return err
+	}
+	return writeFileAtomic(path, []byte(hex.EncodeToString(v.pepper)+"\n"), 0600)
+}
+
+// SigningSecret returns the HMAC key for signed requests made with key.
+func (v *signatureVerifier) SigningSecret(key ApiKey) string {
+	mac := hmac.New(sha256.New, v.pepper)
+	mac.Write([]byte(key.Hash))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// pruneNonces forgets nonces older than twice maxSkew, they can no longer
+// pass the timestamp check.
+func (v *signatureVerifier) pruneNonces() {
+	now := time.Now()
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	for n, seen := range v.nonces {
+		if now.Sub(seen) > 2*v.maxSkew {
+			delete(v.nonces, n)
+		}
+	}
+}
+
+func (v *signatureVerifier) Run() {
+	for range time.Tick(time.Minute) {
+		v.pruneNonces()
+	}
+}
+
+func (v *signatureVerifier) Verify(w http.ResponseWriter, r *http.Request) (ApiKey, error) {
+	keyID := r.Header.Get("X-Key-ID")
+	nonce := r.Header.Get("X-Nonce")
+	if keyID == "" || nonce == "" {
+		return ApiKey{}, fmt.Errorf("X-Key-ID dan X-Nonce wajib")
+	}
+
+	unix, err := strconv.ParseInt(r.Header.Get("X-Timestamp"), 10, 64)
+	if err != nil {
+		return ApiKey{}, fmt.Errorf("X-Timestamp tidak valid")
+	}
+	now := time.Now()
+	skew := now.Sub(time.Unix(unix, 0))
+	if skew < 0 {
+		skew = -skew
+	}
+	if skew > v.maxSkew {
+		return ApiKey{}, fmt.Errorf("timestamp di luar batas %s", v.maxSkew)
+	}
+
+	key, ok := apiKeys.Lookup(keyID)
+	if !ok {
+		return ApiKey{}, fmt.Errorf("key %q tidak dikenal", keyID)
+	}
+
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxSignedBody))
+	if err != nil {
+		return ApiKey{}, err
+	}
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	expected := signRequest(v.SigningSecret(key), r.Method, r.URL.RequestURI(), r.Header.Get("X-Timestamp"), nonce, body)
+	given, err := hex.DecodeString(r.Header.Get("X-Signature"))
+	if err != nil || !hmac.Equal(given, expected) {
+		return ApiKey{}, fmt.Errorf("signature tidak cocok untuk key %s", keyID)
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if v.nonces == nil {
+		v.nonces = make(map[string]time.Time)
+	}
+	nonceKey := keyID + ":" + nonce
+	if _, used := v.nonces[nonceKey]; used {
+		return ApiKey{}, fmt.Errorf("nonce sudah dipakai")
+	}
+	v.nonces[nonceKey] = now
+
+	return key, nil
+}
+
+func signRequest(secret, method, uri, timestamp, nonce string, body []byte) []byte {
+	bodyHash := sha256.Sum256(body)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(method + "\n" + uri + "\n" + timestamp + "\n" + nonce + "\n" + hex.EncodeToString(bodyHash[:])))
+	return mac.Sum(nil)
+}
+
+// AuditEntry is one line of the append-only audit log.
+type AuditEntry struct {
+	Time     string     `json:"time"`
+	Action   string     `json:"action"`
+	Actor    string     `json:"actor"` // API key ID, "scheduler" or "startup"
+	SourceIP string     `json:"source_ip,omitempty"`
+	Password string     `json:"password,omitempty"`
+	Before   *UserStore `json:"before,omitempty"`
+	After    *UserStore `json:"after,omitempty"`
+	Detail   string     `json:"detail,omitempty"`
+	Result   string     `json:"result"` // "success" or "error"
+	Status   int        `json:"status,omitempty"`
+	Message  string     `json:"message,omitempty"`
+	// RestartError is set when the change was saved but restarting the
+	// service afterwards failed.
+	RestartError string `json:"restart_error,omitempty"`
+}
+
+type AuditFilter struct {
+	Password string
+	Action   string
+	Actor    string
+	Since    time.Time
+	Until    time.Time
+	Limit    int
+}
+
+// auditRecord is filled in by a handler while auditMiddleware captures
+// the response status and message.
+type auditRecord struct {
+	Password     string
+	Before       *UserStore
+	After        *UserStore
+	Detail       string
+	Skip         bool
+	RestartError string // Set by writeRestartFailed
+}
+
+type auditContextKey struct{}
+
+type auditResponseWriter struct {
+	http.ResponseWriter
+	status  int
+	message string
+}
+
+func (w *auditResponseWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// auditMiddleware writes one audit entry per request once next returns,
+// including requests rejected by validation.
+func auditMiddleware(action string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rec := &auditRecord{}
+		aw := &auditResponseWriter{ResponseWriter: w, status: http.StatusOK}
+		next(aw, r.WithContext(context.WithValue(r.Context(), auditContextKey{}, rec)))
+		if rec.Skip {
+			return
+		}
+
+		entry := AuditEntry{
+			Action:   action,
+			Actor:    requestKey(r).ID,
+			SourceIP: remoteIP(r),
+			Password: rec.Password,
+			Before:   rec.Before,
+			After:    rec.After,
+			Detail:   rec.Detail,
+			Result:   "success",
+			Status:   aw.status,
+			Message:  aw.message,
+			// A failed restart does not undo a saved change.
+			RestartError: rec.RestartError,
+		}
+		if aw.status >= 400 && rec.RestartError == "" {
+			entry.Result = "error"
+			entry.After = nil
+		}
+		auditLog.Record(entry)
+	}
+}
+
+// auditFrom returns the audit record of r. Outside auditMiddleware it
+// returns a throwaway record so handlers never need a nil check.
+func auditFrom(r *http.Request) *auditRecord {
+	if rec, ok := r.Context().Value(auditContextKey{}).(*auditRecord); ok {
+		return rec
+	}
+	return &auditRecord{}
+}
+
+// remoteIP returns the client IP. X-Forwarded-For is only used when the
+// peer is a trusted proxy, and then the right-most address that is not a
+// trusted proxy itself is the client.
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if !containsIP(trustedProxies, host) {
+		return host
+	}
+
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if net.ParseIP(hop) == nil {
+			break
+		}
+		host = hop
+		if !containsIP(trustedProxies, hop) {
+			break
+		}
+	}
+	return host
+}
+
+// allowlistMiddleware rejects clients outside allowedIPs before any
+// other processing.
+func allowlistMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(allowedIPs) > 0 {
+			if ip := remoteIP(r); !containsIP(allowedIPs, ip) {
+				log.Printf("%s %s ditolak dari IP %s", r.Method, r.URL.Path, ip)
+				writeError(w, r, &apiError{Status: http.StatusForbidden, Code: CodeIPNotAllowed, Msg: "ip_not_allowed", Args: []interface{}{ip}})
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// rateClass groups routes for rate limiting by the scope they require.
+func rateClass(scope string) string {
+	switch scope {
+	case "":
+		return "public"
+	case ScopeRead, ScopeMetrics:
+		return "read"
+	case ScopeAdmin:
+		return "admin"
+	default:
+		return "write"
+	}
+}
+
+// rateLimitMiddleware rejects banned source IPs and throttles the rest
+// with a token bucket per IP and route class. It runs before
+// authMiddleware so key-guessing is throttled too.
+func rateLimitMiddleware(class string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err, wait := limiter.Check(class, remoteIP(r)); err != nil {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			writeError(w, r, err)
+			return
+		}
+		next(w, r)
+	}
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+type ipBan struct {
+	at       time.Time
+	until    time.Time
+	failures int
+}
+
+// IPBan is a ban as listed by /bans.
+type IPBan struct {
+	IP       string `json:"ip"`
+	BannedAt string `json:"banned_at"`
+	Until    string `json:"until"`
+	Failures int    `json:"failures"`
+}
+
+// ipLimiter keeps the token buckets, recent authentication failures and
+// bans, all in memory. Exempt networks are never limited or banned.
+type ipLimiter struct {
+	mu           sync.Mutex
+	limits       map[string]RateLimit
+	exempt       []*net.IPNet
+	banThreshold int
+	banWindow    time.Duration
+	banDuration  time.Duration
+	buckets      map[string]*tokenBucket // Keyed by class + " " + IP
+	failures     map[string][]time.Time
+	bans         map[string]ipBan
+	now          func() time.Time
+}
+
+func newIPLimiter() *ipLimiter {
+	return &ipLimiter{
+		buckets:  make(map[string]*tokenBucket),
+		failures: make(map[string][]time.Time),
+		bans:     make(map[string]ipBan),
+		now:      time.Now,
+	}
+}
+
+// parseCIDRs parses networks, accepting plain IPs as single hosts.
+func parseCIDRs(values []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, v := range values {
+		if !strings.Contains(v, "/") {
+			ip := net.ParseIP(v)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP %q", v)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(v)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+func containsIP(nets []*net.IPNet, ip string) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	for _, n := range nets {
+		if n.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+// Check takes a token for ip in class. It returns the error to send and
+// how long the client should wait when the request is refused.
+func (l *ipLimiter) Check(class, ip string) (*apiError, time.Duration) {
+	if containsIP(l.exempt, ip) {
+		return nil, 0
+	}
+
+	now := l.now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if ban, ok := l.bans[ip]; ok {
+		if now.Before(ban.until) {
+			wait := ban.until.Sub(now)
+			return &apiError{Status: http.StatusForbidden, Code: CodeIPBanned, Msg: "ip_banned", Args: []interface{}{int(math.Ceil(wait.Seconds()))}}, wait
+		}
+		delete(l.bans, ip)
+	}
+
+	limit, ok := l.limits[class]
+	if !ok || limit.Rate <= 0 || limit.Burst <= 0 {
+		return nil, 0
+	}
+	key := class + " " + ip
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: float64(limit.Burst), last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(float64(limit.Burst), b.tokens+now.Sub(b.last).Seconds()*limit.Rate)
+	b.last = now
+	if b.tokens < 1 {
+		wait := time.Duration((1 - b.tokens) / limit.Rate * float64(time.Second))
+		return &apiError{Status: http.StatusTooManyRequests, Code: CodeRateLimited, Msg: "rate_limited", Args: []interface{}{int(math.Ceil(wait.Seconds()))}}, wait
+	}
+	b.tokens--
+	return nil, 0
+}
+
+// Failure records a failed authentication from ip and bans it once
+// banThreshold failures fall within banWindow.
+func (l *ipLimiter) Failure(ip string) {
+	if l.banThreshold <= 0 || containsIP(l.exempt, ip) {
+		return
+	}
+
+	now := l.now()
+	l.mu.Lock()
+	recent := l.failures[ip][:0]
+	for _, t := range l.failures[ip] {
+		if now.Sub(t) < l.banWindow {
+			recent = append(recent, t)
+		}
+	}
+	recent = append(recent, now)
+	if len(recent) < l.banThreshold {
+		l.failures[ip] = recent
+		l.mu.Unlock()
+		return
+	}
+	delete(l.failures, ip)
+	ban := ipBan{at: now, until: now.Add(l.banDuration), failures: len(recent)}
+	l.bans[ip] = ban
+	l.mu.Unlock()
+
+	log.Printf("IP %s diblokir sampai %s setelah %d kali gagal autentikasi", ip, ban.until.Format(time.RFC3339), ban.failures)
+	auditLog.Record(AuditEntry{
+		Action:   "ban",
+		Actor:    "rate_limiter",
+		SourceIP: ip,
+		Result:   "success",
+		Message:  fmt.Sprintf("%d kali gagal autentikasi, diblokir sampai %s", ban.failures, ban.until.Format(time.RFC3339)),
+	})
+}
+
+func (l *ipLimiter) Bans() []IPBan {
+	now := l.now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	bans := []IPBan{}
+	for ip, ban := range l.bans {
+		if !now.Before(ban.until) {
+			continue
+		}
+		bans = append(bans, IPBan{
+			IP:       ip,
+			BannedAt: ban.at.Format(time.RFC3339),
+			Until:    ban.until.Format(time.RFC3339),
+			Failures: ban.failures,
+		})
+	}
+	sort.Slice(bans, func(i, j int) bool { return bans[i].BannedAt < bans[j].BannedAt })
+	return bans
+}
+
+// Clear lifts the ban on ip, or every ban when ip is empty, and forgets
+// the recorded failures. It returns how many bans were lifted.
+func (l *ipLimiter) Clear(ip string) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if ip == "" {
+		n := len(l.bans)
+		l.bans = make(map[string]ipBan)
+		l.failures = make(map[string][]time.Time)
+		return n
+	}
+	delete(l.failures, ip)
+	if _, ok := l.bans[ip]; !ok {
+		return 0
+	}
+	delete(l.bans, ip)
+	return 1
+}
+
+// prune drops expired bans, old failures and buckets that have refilled,
+// so scans from many addresses do not grow memory without bound.
+func (l *ipLimiter) prune() {
+	now := l.now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for ip, ban := range l.bans {
+		if !now.Before(ban.until) {
+			delete(l.bans, ip)
+		}
+	}
+	for ip, times := range l.failures {
+		if len(times) == 0 || now.Sub(times[len(times)-1]) >= l.banWindow {
+			delete(l.failures, ip)
+		}
+	}
+	for key, b := range l.buckets {
+		class := strings.SplitN(key, " ", 2)[0]
+		limit := l.limits[class]
+		if limit.Rate <= 0 || b.tokens+now.Sub(b.last).Seconds()*limit.Rate >= float64(limit.Burst) {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+func (l *ipLimiter) Run() {
+	for range time.Tick(time.Minute) {
+		l.prune()
+	}
+}
+
+// auditLogger appends JSON lines to the audit log. The file is only ever
+// opened with O_APPEND.
+type auditLogger struct {
+	mu   sync.Mutex
+	path string
+}
+
+func (a *auditLogger) Record(entry AuditEntry) {
+	if entry.Time == "" {
+		entry.Time = time.Now().Format(time.RFC3339)
+	}
+	// Successful user changes are also published to webhooks and the
+	// event stream.
+	if event, ok := userEvents[entry.Action]; ok && entry.Result == "success" {
+		webhooks.Publish(event, entry)
+		events.Publish(event, newUserEventData(entry))
+	}
+
+	line, err := json.Marshal(entry)
+	if err != nil {
+		log.Printf("Audit: %v", err)
+		return
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	f, err := os.OpenFile(a.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		log.Printf("Audit: gagal membuka %s: %v", a.path, err)
+		return
+	}
+	defer f.Close()
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		log.Printf("Audit: gagal menulis %s: %v", a.path, err)
+		return
+	}
+	f.Sync()
+}
+
+// Query returns the most recent entries matching filter, oldest first.
+func (a *auditLogger) Query(filter AuditFilter) ([]AuditEntry, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	entries := []AuditEntry{}
+	f, err := os.Open(a.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return entries, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var entry AuditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			continue
+		}
+		if filter.Password != "" && entry.Password != filter.Password {
+			continue
+		}
+		if filter.Action != "" && entry.Action != filter.Action {
+			continue
+		}
+		if filter.Actor != "" && entry.Actor != filter.Actor {
+			continue
+		}
+		if !filter.Since.IsZero() || !filter.Until.IsZero() {
+			t, err := time.Parse(time.RFC3339, entry.Time)
+			if err != nil {
+				continue
+			}
+			if !filter.Since.IsZero() && t.Before(filter.Since) {
+				continue
+			}
+			if !filter.Until.IsZero() && t.After(filter.Until) {
+				continue
+			}
+		}
+		entries = append(entries, entry)
+		if filter.Limit > 0 && len(entries) > filter.Limit {
+			entries = entries[1:]
+		}
+	}
+	return entries, scanner.Err()
+}
+
+// StreamEvent is one event on /events. Data is a UserEventData for user
+// events and a RestartEventData for restart events.
+type StreamEvent struct {
+	ID   uint64      `json:"id,omitempty"`
+	Type string      `json:"type"`
+	Time string      `json:"time"`
+	Data interface{} `json:"data,omitempty"`
+}
+
+type UserEventData struct {
+	Password string     `json:"password"`
+	Actor    string     `json:"actor"`
+	User     *UserStore `json:"user,omitempty"` // After the change, before it for deletes
+	Detail   string     `json:"detail,omitempty"`
+}
+
+func newUserEventData(entry AuditEntry) UserEventData {
+	user := entry.After
+	if user == nil {
+		user = entry.Before
+	}
+	return UserEventData{Password: entry.Password, Actor: entry.Actor, User: user, Detail: entry.Detail}
+}
+
+type RestartEventData struct {
+	DurationMs int64  `json:"duration_ms,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+const (
+	eventHistorySize   = 500
+	eventSubscriberBuf = 64
+)
+
+// eventHub fans events out to /events subscribers and keeps the last
+// eventHistorySize events for Last-Event-ID resume. IDs start at the
+// startup time in nanoseconds, so they keep increasing across restarts of
+// the API and an ID from before a restart is simply too old to resume.
+type eventHub struct {
+	mu      sync.Mutex
+	nextID  uint64
+	history []StreamEvent
+	subs    map[chan StreamEvent]struct{}
+}
+
+func newEventHub() *eventHub {
+	return &eventHub{
+		nextID: uint64(time.Now().UnixNano()),
+		subs:   make(map[chan StreamEvent]struct{}),
+	}
+}
+
+func (h *eventHub) Publish(typ string, data interface{}) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	event := StreamEvent{ID: h.nextID, Type: typ, Time: time.Now().Format(time.RFC3339), Data: data}
+	h.nextID++
+	h.history = append(h.history, event)
+	if len(h.history) > eventHistorySize {
+		h.history = h.history[len(h.history)-eventHistorySize:]
+	}
+
+	for ch := range h.subs {
+		select {
+		case ch <- event:
+		default:
+			// Too slow; drop it rather than block the publisher.
+			delete(h.subs, ch)
+			close(ch)
+		}
+	}
+}
+
+// Subscribe registers a subscriber. With resume set, it also returns the
+// events after lastID, or a reset event if some of them are gone.
+func (h *eventHub) Subscribe(resume bool, lastID uint64) ([]StreamEvent, chan StreamEvent, *StreamEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	ch := make(chan StreamEvent, eventSubscriberBuf)
+	h.subs[ch] = struct{}{}
+	if !resume {
+		return nil, ch, nil
+	}
+
+	var oldest uint64
+	if len(h.history) > 0 {
+		oldest = h.history[0].ID
+	} else {
+		oldest = h.nextID
+	}
+	if lastID+1 < oldest || lastID >= h.nextID {
+		reset := &StreamEvent{Type: "reset", Time: time.Now().Format(time.RFC3339)}
+		if h.nextID > 0 {
+			reset.ID = h.nextID - 1
+		}
+		return nil, ch, reset
+	}
+
+	var backlog []StreamEvent
+	for _, event := range h.history {
+		if event.ID > lastID {
+			backlog = append(backlog, event)
+		}
+	}
+	return backlog, ch, nil
+}
+
+func (h *eventHub) Unsubscribe(ch chan StreamEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := h.subs[ch]; ok {
+		delete(h.subs, ch)
+		close(ch)
+	}
+}
+
+// userEvents maps audit actions to the event they publish to webhooks and
+// the /events stream.
+var userEvents = map[string]string{
+	"create": "user.created",
+	"renew":  "user.renewed",
+	"delete": "user.deleted",
+	"expire": "user.expired",
+	"lock":   "user.locked",
+	"unlock": "user.unlocked",
+}
+
+func validWebhookEvent(event string) bool {
+	for _, e := range userEvents {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+const (
+	webhookMaxAttempts = 8
+	webhookBaseBackoff = 30 * time.Second
+	webhookMaxBackoff  = time.Hour
+	// The delivery log is rotated to a single ".1" file once it reaches
+	// webhookLogMaxBytes.
+	webhookLogMaxBytes = 4 << 20
+)
+
+// Webhook is a subscription from WebhooksFile. Secret signs every payload
+// and is only returned when the webhook is created.
+type Webhook struct {
+	ID        string   `json:"id"`
+	URL       string   `json:"url"`
+	Events    []string `json:"events"`
+	Secret    string   `json:"secret,omitempty"`
+	CreatedAt string   `json:"created_at"`
+}
+
+func (h Webhook) wants(event string) bool {
+	if len(h.Events) == 0 {
+		return true
+	}
+	for _, e := range h.Events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+// WebhookEvent is the JSON body POSTed to subscribers. ID is shared by
+// every webhook receiving the same event and can be used to deduplicate.
+type WebhookEvent struct {
+	ID     string     `json:"id"`
+	Event  string     `json:"event"`
+	Time   string     `json:"time"`
+	Actor  string     `json:"actor"`
+	User   *UserStore `json:"user,omitempty"`
+	Detail string     `json:"detail,omitempty"`
+}
+
+// webhookJob is one pending delivery in WebhookQueueFile.
+type webhookJob struct {
+	ID        string          `json:"id"`
+	WebhookID string          `json:"webhook_id"`
+	Event     string          `json:"event"`
+	Payload   json.RawMessage `json:"payload"`
+	Attempts  int             `json:"attempts"`
+	NextAt    time.Time       `json:"next_at"`
+}
+
+// WebhookDelivery is one attempt in the delivery log.
+type WebhookDelivery struct {
+	Time       string `json:"time"`
+	DeliveryID string `json:"delivery_id"`
+	WebhookID  string `json:"webhook_id"`
+	Event      string `json:"event"`
+	Attempt    int    `json:"attempt"`
+	Status     int    `json:"status,omitempty"` // 0 when there was no response
+	Result     string `json:"result"`           // "success", "retry" or "failed"
+	Error      string `json:"error,omitempty"`
+	DurationMs int64  `json:"duration_ms"`
+}
+
+type DeliveryFilter struct {
+	WebhookID string
+	Event     string
+	Result    string
+	Limit     int
+}
+
+// webhookManager keeps the subscriptions and a persistent retry queue.
+// Every change to the queue is written to disk before it is acted on, so
+// pending deliveries survive a restart of the API.
+type webhookManager struct {
+	mu        sync.Mutex
+	path      string
+	queuePath string
+	logPath   string
+	hooks     []Webhook
+	queue     []webhookJob
+	wake      chan struct{}
+	client    *http.Client
+
+	logMu sync.Mutex
+}
+
+func (m *webhookManager) Load() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for path, dst := range map[string]interface{}{m.path: &m.hooks, m.queuePath: &m.queue} {
+		file, err := ioutil.ReadFile(path)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return err
+		}
+		if err := json.Unmarshal(file, dst); err != nil {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+	}
+	return nil
+}
+
+func (m *webhookManager) saveHooksLocked() error {
+	data, err := json.MarshalIndent(m.hooks, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(m.path, data, 0600)
+}
+
+func (m *webhookManager) saveQueueLocked() error {
+	data, err := json.Marshal(m.queue)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(m.queuePath, data, 0600)
+}
+
+func randomID(n int) (string, error) {
+	buf := make([]byte, n)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+// Create adds a webhook and returns it with its secret.
+func (m *webhookManager) Create(rawURL string, events []string) (Webhook, error) {
+	id, err := randomID(4)
+	if err != nil {
+		return Webhook{}, err
+	}
+	secret, err := randomID(24)
+	if err != nil {
+		return Webhook{}, err
+	}
+	if events == nil {
+		events = []string{}
+	}
+	hook := Webhook{
+		ID:        id,
+		URL:       rawURL,
+		Events:    events,
+		Secret:    secret,
+		CreatedAt: time.Now().Format(time.RFC3339),
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.hooks = append(m.hooks, hook)
+	if err := m.saveHooksLocked(); err != nil {
+		m.hooks = m.hooks[:len(m.hooks)-1]
+		return Webhook{}, err
+	}
+	return hook, nil
+}
+
+// Delete removes a webhook together with its pending deliveries.
+func (m *webhookManager) Delete(id string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for i, hook := range m.hooks {
+		if hook.ID != id {
+			continue
+		}
+		old := m.hooks
+		m.hooks = append(old[:i:i], old[i+1:]...)
+		if err := m.saveHooksLocked(); err != nil {
+			m.hooks = old
+			return true, err
+		}
+		queue := m.queue[:0]
+		for _, job := range m.queue {
+			if job.WebhookID != id {
+				queue = append(queue, job)
+			}
+		}
+		m.queue = queue
+		if err := m.saveQueueLocked(); err != nil {
+			log.Printf("Webhook: gagal menyimpan queue: %v", err)
+		}
+		return true, nil
+	}
+	return false, nil
+}
+
+// List returns every webhook without its secret.
+func (m *webhookManager) List() []Webhook {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	hooks := make([]Webhook, 0, len(m.hooks))
+	for _, hook := range m.hooks {
+		hook.Secret = ""
+		hooks = append(hooks, hook)
+	}
+	return hooks
+}
+
+// Publish queues a delivery of event to every subscribed webhook.
+func (m *webhookManager) Publish(event string, entry AuditEntry) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if len(m.hooks) == 0 {
+		return
+	}
+
+	eventID, err := randomID(8)
+	if err != nil {
+		log.Printf("Webhook: %v", err)
+		return
+	}
+	user := entry.After
+	if user == nil {
+		user = entry.Before
+	}
+	payload, err := json.Marshal(WebhookEvent{
+		ID:     eventID,
+		Event:  event,
+		Time:   entry.Time,
+		Actor:  entry.Actor,
+		User:   user,
+		Detail: entry.Detail,
+	})
+	if err != nil {
+		log.Printf("Webhook: %v", err)
+		return
+	}
+
+	queued := 0
+	now := time.Now()
+	for _, hook := range m.hooks {
+		if !hook.wants(event) {
+			continue
+		}
+		jobID, err := randomID(8)
+		if err != nil {
+			log.Printf("Webhook: %v", err)
+			continue
+		}
+		m.queue = append(m.queue, webhookJob{
+			ID:        jobID,
+			WebhookID: hook.ID,
+			Event:     event,
+			Payload:   payload,
+			NextAt:    now,
+		})
+		queued++
+	}
+	if queued == 0 {
+		return
+	}
+	if err := m.saveQueueLocked(); err != nil {
+		log.Printf("Webhook: gagal menyimpan queue: %v", err)
+	}
+	select {
+	case m.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Run delivers queued jobs as they become due. It never returns.
+func (m *webhookManager) Run() {
+	for {
+		wait := m.deliverDue()
+		timer := time.NewTimer(wait)
+		select {
+		case <-m.wake:
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+}
+
+// deliverDue attempts every due job once and returns how long to wait
+// for the next one. Webhooks are served in parallel so a slow or dead
+// endpoint cannot hold up the others.
+func (m *webhookManager) deliverDue() time.Duration {
+	now := time.Now()
+	m.mu.Lock()
+	due := make(map[string][]webhookJob)
+	hooks := make(map[string]Webhook)
+	for _, job := range m.queue {
+		if !job.NextAt.After(now) {
+			due[job.WebhookID] = append(due[job.WebhookID], job)
+		}
+	}
+	for _, hook := range m.hooks {
+		hooks[hook.ID] = hook
+	}
+	m.mu.Unlock()
+
+	var wg sync.WaitGroup
+	for id, jobs := range due {
+		hook, ok := hooks[id]
+		if !ok {
+			for _, job := range jobs {
+				m.finish(job, true)
+			}
+			continue
+		}
+		wg.Add(1)
+		go func(hook Webhook, jobs []webhookJob) {
+			defer wg.Done()
+			m.deliverHook(hook, jobs)
+		}(hook, jobs)
+	}
+	wg.Wait()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	wait := time.Hour
+	now = time.Now()
+	for _, job := range m.queue {
+		if d := job.NextAt.Sub(now); d < wait {
+			wait = d
+		}
+	}
+	if wait < 0 {
+		wait = 0
+	}
+	return wait
+}
+
+// deliverHook attempts the due jobs of one webhook in queue order. After
+// a failed attempt the remaining jobs are postponed to the retry time
+// without using up an attempt.
+func (m *webhookManager) deliverHook(hook Webhook, jobs []webhookJob) {
+	for i, job := range jobs {
+		job.Attempts++
+		start := time.Now()
+		status, err := m.send(hook, job)
+		delivery := WebhookDelivery{
+			Time:       start.Format(time.RFC3339),
+			DeliveryID: job.ID,
+			WebhookID:  job.WebhookID,
+			Event:      job.Event,
+			Attempt:    job.Attempts,
+			Status:     status,
+			Result:     "success",
+			DurationMs: time.Since(start).Milliseconds(),
+		}
+		done := err == nil
+		if err != nil {
+			delivery.Error = err.Error()
+			delivery.Result = "retry"
+			if job.Attempts >= webhookMaxAttempts {
+				delivery.Result = "failed"
+				done = true
+				log.Printf("Webhook %s: %s %s gagal setelah %d percobaan: %v", hook.ID, job.Event, job.ID, job.Attempts, err)
+			}
+		}
+		m.logDelivery(delivery)
+		next := m.finish(job, done)
+		if err != nil {
+			if next.IsZero() {
+				next = time.Now().Add(webhookBaseBackoff)
+			}
+			m.postpone(jobs[i+1:], next)
+			return
+		}
+	}
+}
+
+// finish removes job from the queue when done, or schedules its next
+// attempt with exponential backoff and returns the time of that attempt.
+func (m *webhookManager) finish(job webhookJob, done bool) time.Time {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for i := range m.queue {
+		if m.queue[i].ID != job.ID {
+			continue
+		}
+		if done {
+			m.queue = append(m.queue[:i], m.queue[i+1:]...)
+		} else {
+			backoff := webhookBaseBackoff << uint(job.Attempts-1)
+			if backoff > webhookMaxBackoff || backoff <= 0 {
+				backoff = webhookMaxBackoff
+			}
+			job.NextAt = time.Now().Add(backoff)
+			m.queue[i] = job
+		}
+		if err := m.saveQueueLocked(); err != nil {
+			log.Printf("Webhook: gagal menyimpan queue: %v", err)
+		}
+		return job.NextAt
+	}
+	return time.Time{}
+}
+
+// postpone moves jobs that are due before until to until.
+func (m *webhookManager) postpone(jobs []webhookJob, until time.Time) {
+	if len(jobs) == 0 {
+		return
+	}
+	ids := make(map[string]bool, len(jobs))
+	for _, job := range jobs {
+		ids[job.ID] = true
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i := range m.queue {
+		if ids[m.queue[i].ID] && m.queue[i].NextAt.Before(until) {
+			m.queue[i].NextAt = until
+		}
+	}
+	if err := m.saveQueueLocked(); err != nil {
+		log.Printf("Webhook: gagal menyimpan queue: %v", err)
+	}
+}
+
+// send POSTs the payload signed with the webhook secret. The signature
+// is hex HMAC-SHA256 over TIMESTAMP + "." + body. Any 2xx response
+// counts as delivered.
+func (m *webhookManager) send(hook Webhook, job webhookJob) (int, error) {
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	mac := hmac.New(sha256.New, []byte(hook.Secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(job.Payload)
+
+	req, err := http.NewRequest(http.MethodPost, hook.URL, bytes.NewReader(job.Payload))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "zivpn-api")
+	req.Header.Set("X-Zivpn-Event", job.Event)
+	req.Header.Set("X-Zivpn-Delivery", job.ID)
+	req.Header.Set("X-Zivpn-Timestamp", timestamp)
+	req.Header.Set("X-Zivpn-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+
+	resp, err := m.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 64*1024))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("HTTP %d", resp.StatusCode)
+	}
+	return resp.StatusCode, nil
+}
+
+func (m *webhookManager) logDelivery(delivery WebhookDelivery) {
+	line, err := json.Marshal(delivery)
+	if err != nil {
+		log.Printf("Webhook: %v", err)
+		return
+	}
+
+	m.logMu.Lock()
+	defer m.logMu.Unlock()
+
+	if info, err := os.Stat(m.logPath); err == nil && info.Size() >= webhookLogMaxBytes {
+		if err := os.Rename(m.logPath, m.logPath+".1"); err != nil {
+			log.Printf("Webhook: gagal merotasi %s: %v", m.logPath, err)
+		}
+	}
+
+	f, err := os.OpenFile(m.logPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		log.Printf("Webhook: gagal membuka %s: %v", m.logPath, err)
+		return
+	}
+	defer f.Close()
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		log.Printf("Webhook: gagal menulis %s: %v", m.logPath, err)
+	}
+}
+
+// Deliveries returns the most recent attempts matching filter, oldest
+// first. Only the current log and its last rotation are read.
+func (m *webhookManager) Deliveries(filter DeliveryFilter) ([]WebhookDelivery, error) {
+	m.logMu.Lock()
+	defer m.logMu.Unlock()
+
+	deliveries := []WebhookDelivery{}
+	for _, path := range []string{m.logPath + ".1", m.logPath} {
+		f, err := os.Open(path)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, err
+		}
+
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			var d WebhookDelivery
+			if err := json.Unmarshal(scanner.Bytes(), &d); err != nil {
+				continue
+			}
+			if filter.WebhookID != "" && d.WebhookID != filter.WebhookID {
+				continue
+			}
+			if filter.Event != "" && d.Event != filter.Event {
+				continue
+			}
+			if filter.Result != "" && d.Result != filter.Result {
+				continue
+			}
+			deliveries = append(deliveries, d)
+			if filter.Limit > 0 && len(deliveries) > filter.Limit {
+				deliveries = deliveries[1:]
+			}
+		}
+		err = scanner.Err()
+		f.Close()
+		if err != nil {
+			return nil, err
 		}
 	}
+	return deliveries, nil
+}
 
-	if !exists {
-		config.Auth.Config = append(config.Auth.Config, password)
-		saveConfig(config)
-		restartService()
+// isExpired reports whether u has expired at now. Records with an
+// unreadable expiry are never treated as expired.
+func isExpired(u UserStore, now time.Time) bool {
+	t, err := parseExpiry(u.Expired)
+	if err != nil {
+		return false
 	}
+	return !now.Before(t)
 }
 
-
 func loadConfig() (Config, error) {
 	var config Config
 	file, err := ioutil.ReadFile(ConfigFile)
@@ -484,12 +5987,96 @@ func saveConfig(config Config) error {
 	if err != nil {
 		return err
 	}
-	return ioutil.WriteFile(ConfigFile, data, 0644)
+	return writeFileAtomic(ConfigFile, data, 0644)
 }
 
 func loadUsers() ([]UserStore, error) {
+	return store.List()
+}
+
+func saveUsers(users []UserStore) error {
+	return store.Replace(users)
+}
+
+func loadApiConfig() (ApiConfig, error) {
+	config := ApiConfig{
+		Storage:          "json",
+		BoltPath:         UserBoltDB,
+		RestartWindow:    3,
+		ExpirySchedule:   "* * * * *",
+		SignatureMaxSkew: 300,
+		PasswordLength:   10,
+		PasswordCharset:  "abcdefghijkmnpqrstuvwxyz23456789",
+		RateLimits: map[string]RateLimit{
+			"public": {Rate: 5, Burst: 20},
+			"read":   {Rate: 10, Burst: 40},
+			"write":  {Rate: 5, Burst: 20},
+			"admin":  {Rate: 2, Burst: 10},
+		},
+		BanThreshold:    10,
+		BanWindow:       600,
+		BanDuration:     900,
+		RateLimitExempt: []string{"127.0.0.0/8", "::1/128"},
+	}
+	file, err := ioutil.ReadFile(ApiConfigFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return config, nil
+		}
+		return config, err
+	}
+	if err = json.Unmarshal(file, &config); err != nil {
+		return config, err
+	}
+	if config.SignatureMaxSkew <= 0 {
+		return config, fmt.Errorf("signature_max_skew harus lebih dari 0")
+	}
+	switch config.JournalRecovery {
+	case "", "rollback", "forward":
+	default:
+		return config, fmt.Errorf("journal_recovery %q tidak dikenal, gunakan rollback atau forward", config.JournalRecovery)
+	}
+	return config, nil
+}
+
+// UserStorage is the persistence layer for the user database. config.json
+// stays a plain file because the zivpn core reads it directly.
+type UserStorage interface {
+	List() ([]UserStore, error)
+	Get(password string) (UserStore, bool, error)
+	Put(user UserStore) error
+	Delete(password string) (bool, error)
+	Replace(users []UserStore) error
+	// Backup writes a consistent copy of the database file to w, safe to
+	// take while the API is running.
+	Backup(w io.Writer) error
+	Close() error
+}
+
+func openUserStorage(config ApiConfig) (UserStorage, error) {
+	switch config.Storage {
+	case "", "json":
+		return &jsonUserStorage{path: UserDB}, nil
+	case "bolt":
+		path := config.BoltPath
+		if path == "" {
+			path = UserBoltDB
+		}
+		return openBoltUserStorage(path, UserDB)
+	default:
+		return nil, fmt.Errorf("unknown storage %q", config.Storage)
+	}
+}
+
+// jsonUserStorage keeps every user in a single JSON array file. Callers
+// serialize access through mutex.
+type jsonUserStorage struct {
+	path string
+}
+
+func (s *jsonUserStorage) List() ([]UserStore, error) {
 	var users []UserStore
-	file, err := ioutil.ReadFile(UserDB)
+	file, err := ioutil.ReadFile(s.path)
 	if err != nil {
 		if os.IsNotExist(err) {
 			return users, nil
@@ -500,12 +6087,563 @@ func loadUsers() ([]UserStore, error) {
 	return users, err
 }
 
-func saveUsers(users []UserStore) error {
+func (s *jsonUserStorage) Get(password string) (UserStore, bool, error) {
+	users, err := s.List()
+	if err != nil {
+		return UserStore{}, false, err
+	}
+	for _, u := range users {
+		if u.Password == password {
+			return u, true, nil
+		}
+	}
+	return UserStore{}, false, nil
+}
+
+func (s *jsonUserStorage) Put(user UserStore) error {
+	users, err := s.List()
+	if err != nil {
+		return err
+	}
+	replaced := false
+	for i, u := range users {
+		if u.Password == user.Password {
+			users[i] = user
+			replaced = true
+			break
+		}
+	}
+	if !replaced {
+		users = append(users, user)
+	}
+	return s.Replace(users)
+}
+
+func (s *jsonUserStorage) Delete(password string) (bool, error) {
+	users, err := s.List()
+	if err != nil {
+		return false, err
+	}
+	found := false
+	newUsers := []UserStore{}
+	for _, u := range users {
+		if u.Password == password {
+			found = true
+			continue
+		}
+		newUsers = append(newUsers, u)
+	}
+	if !found {
+		return false, nil
+	}
+	return true, s.Replace(newUsers)
+}
+
+func (s *jsonUserStorage) Replace(users []UserStore) error {
 	data, err := json.MarshalIndent(users, "", "  ")
 	if err != nil {
 		return err
 	}
-	return ioutil.WriteFile(UserDB, data, 0644)
+	return writeFileAtomic(s.path, data, 0644)
+}
+
+// Backup copies the file as is. Writes replace it atomically, so a read
+// never sees a half-written file. A missing file is an empty database.
+func (s *jsonUserStorage) Backup(w io.Writer) error {
+	f, err := os.Open(s.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			_, err = io.WriteString(w, "[]")
+		}
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(w, f)
+	return err
+}
+
+func (s *jsonUserStorage) Close() error {
+	return nil
+}
+
+var (
+	boltUsersBucket = []byte("users")
+	boltMetaBucket  = []byte("meta")
+	boltMigratedKey = []byte("migrated_from_json")
+)
+
+// boltUserStorage stores one record per password in a bbolt bucket, so
+// mutations only touch the affected key.
+type boltUserStorage struct {
+	db *bolt.DB
+}
+
+func openBoltUserStorage(path, legacyPath string) (*boltUserStorage, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	s := &boltUserStorage{db: db}
+	if err := s.migrateFromJSON(legacyPath); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// migrateFromJSON imports users.json once, the first time the bolt store
+// is opened. The JSON file is left in place as a backup.
+func (s *boltUserStorage) migrateFromJSON(legacyPath string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		users, err := tx.CreateBucketIfNotExists(boltUsersBucket)
+		if err != nil {
+			return err
+		}
+		meta, err := tx.CreateBucketIfNotExists(boltMetaBucket)
+		if err != nil {
+			return err
+		}
+		if meta.Get(boltMigratedKey) != nil {
+			return nil
+		}
+
+		legacy, err := (&jsonUserStorage{path: legacyPath}).List()
+		if err != nil {
+			return fmt.Errorf("read %s: %w", legacyPath, err)
+		}
+		for _, u := range legacy {
+			data, err := json.Marshal(u)
+			if err != nil {
+				return err
+			}
+			if err := users.Put([]byte(u.Password), data); err != nil {
+				return err
+			}
+		}
+		if len(legacy) > 0 {
+			log.Printf("Migrated %d users from %s", len(legacy), legacyPath)
+		}
+		return meta.Put(boltMigratedKey, []byte(time.Now().Format(time.RFC3339)))
+	})
+}
+
+func (s *boltUserStorage) List() ([]UserStore, error) {
+	var users []UserStore
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltUsersBucket).ForEach(func(k, v []byte) error {
+			var u UserStore
+			if err := json.Unmarshal(v, &u); err != nil {
+				return err
+			}
+			users = append(users, u)
+			return nil
+		})
+	})
+	return users, err
+}
+
+func (s *boltUserStorage) Get(password string) (UserStore, bool, error) {
+	var u UserStore
+	found := false
+	err := s.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(boltUsersBucket).Get([]byte(password))
+		if v == nil {
+			return nil
+		}
+		found = true
+		return json.Unmarshal(v, &u)
+	})
+	return u, found, err
+}
+
+func (s *boltUserStorage) Put(user UserStore) error {
+	data, err := json.Marshal(user)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltUsersBucket).Put([]byte(user.Password), data)
+	})
+}
+
+func (s *boltUserStorage) Delete(password string) (bool, error) {
+	found := false
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltUsersBucket)
+		if b.Get([]byte(password)) == nil {
+			return nil
+		}
+		found = true
+		return b.Delete([]byte(password))
+	})
+	return found, err
+}
+
+func (s *boltUserStorage) Replace(users []UserStore) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		if err := tx.DeleteBucket(boltUsersBucket); err != nil {
+			return err
+		}
+		b, err := tx.CreateBucket(boltUsersBucket)
+		if err != nil {
+			return err
+		}
+		for _, u := range users {
+			data, err := json.Marshal(u)
+			if err != nil {
+				return err
+			}
+			if err := b.Put([]byte(u.Password), data); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Backup writes the database from a read transaction, the only safe way
+// to copy users.db while it is open.
+func (s *boltUserStorage) Backup(w io.Writer) error {
+	return s.db.View(func(tx *bolt.Tx) error {
+		_, err := tx.WriteTo(w)
+		return err
+	})
+}
+
+func (s *boltUserStorage) Close() error {
+	return s.db.Close()
+}
+
+// writeFileAtomic writes data to a temp file in the same directory, fsyncs it
+// and renames it over path, so readers never see a truncated file.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	dir := filepath.Dir(path)
+	tmp, err := ioutil.TempFile(dir, filepath.Base(path)+".tmp-")
+	if err != nil {
+		return err
+	}
+	tmpName := tmp.Name()
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmpName)
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		os.Remove(tmpName)
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmpName)
+		return err
+	}
+	if err := os.Chmod(tmpName, perm); err != nil {
+		os.Remove(tmpName)
+		return err
+	}
+	if err := os.Rename(tmpName, path); err != nil {
+		os.Remove(tmpName)
+		return err
+	}
+
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+	return nil
+}
+
+// journalEntry records a mutation that spans config.json and the user
+// database. It is written before the first change and removed after the
+// last one, so a leftover entry means the mutation was interrupted.
+type journalEntry struct {
+	Action    string          `json:"action"`
+	Changes   []journalChange `json:"changes"`
+	StartedAt string          `json:"started_at"`
+}
+
+type journalChange struct {
+	Password string       `json:"password"`
+	Before   journalState `json:"before"`
+	After    journalState `json:"after"`
+}
+
+type journalState struct {
+	InConfig bool       `json:"in_config"`
+	User     *UserStore `json:"user,omitempty"`
+}
+
+// beginMutation writes the journal for a new mutation. It refuses while an
+// earlier journal is still on disk, which only happens when a rollback
+// failed: that journal is the only record of how to recover, and is
+// resolved on the next start.
+func beginMutation(action string, changes ...journalChange) error {
+	if _, err := os.Stat(JournalFile); err == nil {
+		log.Printf("Mutasi %s ditolak: %s dari mutasi sebelumnya belum selesai, restart API untuk recovery", action, JournalFile)
+		return fmt.Errorf("%s belum selesai", JournalFile)
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	entry := journalEntry{
+		Action:    action,
+		Changes:   changes,
+		StartedAt: time.Now().Format(time.RFC3339),
+	}
+	data, err := json.MarshalIndent(entry, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(JournalFile, data, 0600)
+}
+
+func commitMutation() {
+	if err := os.Remove(JournalFile); err != nil && !os.IsNotExist(err) {
+		log.Printf("Gagal menghapus journal: %v", err)
+	}
+}
+
+// abortMutation restores the state recorded before the mutation started.
+// If that fails the journal is kept for recovery on the next start.
+func abortMutation() {
+	entry, err := loadJournal()
+	if err != nil || entry == nil {
+		return
+	}
+	if err := applyJournalChanges(entry.Changes, false); err != nil {
+		log.Printf("Rollback %s gagal, journal disimpan: %v", entry.Action, err)
+		return
+	}
+	commitMutation()
+}
+
+func loadJournal() (*journalEntry, error) {
+	data, err := ioutil.ReadFile(JournalFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var entry journalEntry
+	if err := json.Unmarshal(data, &entry); err != nil {
+		return nil, err
+	}
+	return &entry, nil
+}
+
+// applyJournalChanges makes config.json and the user database match the
+// After state of every change, or the Before state when forward is false.
+// config.json is written once. It is idempotent.
+func applyJournalChanges(changes []journalChange, forward bool) error {
+	config, err := loadConfig()
+	if err != nil {
+		return err
+	}
+
+	want := make(map[string]bool)
+	for _, c := range changes {
+		state := c.Before
+		if forward {
+			state = c.After
+		}
+		want[c.Password] = state.InConfig
+	}
+
+	changed := false
+	newConfigAuth := []string{}
+	present := make(map[string]bool)
+	for _, p := range config.Auth.Config {
+		if keep, ok := want[p]; ok && !keep {
+			changed = true
+			continue
+		}
+		present[p] = true
+		newConfigAuth = append(newConfigAuth, p)
+	}
+	for _, c := range changes {
+		if want[c.Password] && !present[c.Password] {
+			present[c.Password] = true
+			newConfigAuth = append(newConfigAuth, c.Password)
+			changed = true
+		}
+	}
+	if changed {
+		config.Auth.Config = newConfigAuth
+		if err := saveConfig(config); err != nil {
+			return err
+		}
+	}
+
+	for _, c := range changes {
+		state := c.Before
+		if forward {
+			state = c.After
+		}
+		if state.User != nil {
+			err = store.Put(*state.User)
+		} else {
+			_, err = store.Delete(c.Password)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkIntegrity runs before the API starts serving. It removes temp files
+// left by interrupted atomic writes, finishes or undoes an interrupted
+// mutation from the journal, and reports files that no longer parse.
+func checkIntegrity(apiConfig ApiConfig) {
+	for _, path := range []string{ConfigFile, UserDB, JournalFile} {
+		leftovers, _ := filepath.Glob(path + ".tmp-*")
+		for _, tmp := range leftovers {
+			log.Printf("Integrity: menghapus file sementara %s", tmp)
+			os.Remove(tmp)
+		}
+	}
+
+	entry, err := loadJournal()
+	if err != nil {
+		log.Printf("Integrity: journal %s rusak, dihapus: %v", JournalFile, err)
+		commitMutation()
+	} else if entry != nil {
+		forward, direction := false, "rollback"
+		if apiConfig.JournalRecovery == "forward" {
+			forward, direction = true, "roll forward"
+		}
+		log.Printf("Integrity: mutasi %s (%d user, mulai %s) tidak selesai, %s", entry.Action, len(entry.Changes), entry.StartedAt, direction)
+
+		result, message := "success", ""
+		if err := applyJournalChanges(entry.Changes, forward); err != nil {
+			log.Printf("Integrity: %s gagal: %v", direction, err)
+			result, message = "error", err.Error()
+		} else {
+			commitMutation()
+		}
+		for _, c := range entry.Changes {
+			after := c.Before.User
+			if forward {
+				after = c.After.User
+			}
+			auditLog.Record(AuditEntry{
+				Action:   "recover",
+				Actor:    "startup",
+				Password: c.Password,
+				Before:   c.Before.User,
+				After:    after,
+				Detail:   fmt.Sprintf("%s %s dari journal (mulai %s)", direction, entry.Action, entry.StartedAt),
+				Result:   result,
+				Message:  message,
+			})
+		}
+	}
+
+	if _, err := loadConfig(); err != nil {
+		log.Printf("Integrity: %s tidak valid: %v", ConfigFile, err)
+	}
+	if _, err := store.List(); err != nil {
+		log.Printf("Integrity: database user tidak valid: %v", err)
+	}
+}
+
+const (
+	RestartNone    = "none"    // No config change, nothing to restart
+	RestartPending = "pending" // Queued, zivpn will restart within the window
+	RestartApplied = "applied" // zivpn was restarted before responding
+)
+
+// restartCoordinator batches config changes into a single zivpn restart.
+// The first request opens a window; everything requested before it closes
+// is applied by one restart.
+type restartCoordinator struct {
+	mu          sync.Mutex
+	window      time.Duration
+	timer       *time.Timer
+	scheduledAt time.Time
+	lastRestart time.Time
+	lastErr     error
+	restarts    int
+	failures    int
+}
+
+type RestartStatus struct {
+	Pending     bool   `json:"pending"`
+	ScheduledAt string `json:"scheduled_at,omitempty"`
+	LastRestart string `json:"last_restart,omitempty"`
+	LastError   string `json:"last_error,omitempty"`
+	Restarts    int    `json:"restarts"`
+	Failures    int    `json:"failures"`
+	WindowSec   int    `json:"window_sec"`
+}
+
+// Request schedules a restart. With a zero window it restarts immediately
+// and returns the result.
+func (c *restartCoordinator) Request() (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.window <= 0 {
+		return RestartApplied, c.runLocked()
+	}
+
+	if c.timer == nil {
+		c.scheduledAt = time.Now().Add(c.window)
+		c.timer = time.AfterFunc(c.window, c.fire)
+	}
+	return RestartPending, nil
+}
+
+func (c *restartCoordinator) fire() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.timer = nil
+	c.scheduledAt = time.Time{}
+	if err := c.runLocked(); err != nil {
+		log.Printf("Gagal merestart service: %v", err)
+	}
+}
+
+func (c *restartCoordinator) runLocked() error {
+	events.Publish("restart.started", nil)
+	start := time.Now()
+	err := restartService()
+	c.lastRestart = time.Now()
+	c.lastErr = err
+	c.restarts++
+	data := RestartEventData{DurationMs: time.Since(start).Milliseconds()}
+	if err != nil {
+		c.failures++
+		data.Error = err.Error()
+		events.Publish("restart.failed", data)
+	} else {
+		events.Publish("restart.finished", data)
+	}
+	return err
+}
+
+func (c *restartCoordinator) Status() RestartStatus {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	status := RestartStatus{
+		Pending:   c.timer != nil,
+		Restarts:  c.restarts,
+		Failures:  c.failures,
+		WindowSec: int(c.window / time.Second),
+	}
+	if !c.scheduledAt.IsZero() {
+		status.ScheduledAt = c.scheduledAt.Format(time.RFC3339)
+	}
+	if !c.lastRestart.IsZero() {
+		status.LastRestart = c.lastRestart.Format(time.RFC3339)
+	}
+	if c.lastErr != nil {
+		status.LastError = c.lastErr.Error()
+	}
+	return status
 }
 
 func restartService() error {
@@ -0,0 +1,931 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeClock is a manually advanced clock for ipLimiter.now.
+type fakeClock struct {
+	t time.Time
+}
+
+func (c *fakeClock) Now() time.Time          { return c.t }
+func (c *fakeClock) Advance(d time.Duration) { c.t = c.t.Add(d) }
+
+func newTestLimiter(t *testing.T) (*ipLimiter, *fakeClock) {
+	t.Helper()
+	// Bans are audited, keep them out of /etc/zivpn.
+	saved := auditLog
+	auditLog = &auditLogger{path: filepath.Join(t.TempDir(), "audit.log")}
+	t.Cleanup(func() { auditLog = saved })
+
+	clock := &fakeClock{t: time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)}
+	l := newIPLimiter()
+	l.now = clock.Now
+	l.limits = map[string]RateLimit{"write": {Rate: 1, Burst: 2}}
+	l.banThreshold = 3
+	l.banWindow = time.Minute
+	l.banDuration = 10 * time.Minute
+	return l, clock
+}
+
+// newTestState points config.json, the user database, the journal and the
+// audit log at a temp dir and fills them. Restarts are only scheduled and
+// the timer is stopped on cleanup.
+func newTestState(t *testing.T, auth []string, users ...UserStore) {
+	t.Helper()
+	dir := t.TempDir()
+	files := []*string{&ConfigFile, &UserDB, &JournalFile, &TelegramMappingsFile}
+	saved := make([]string, len(files))
+	for i, f := range files {
+		saved[i] = *f
+	}
+	savedStore, savedRestarts, savedAudit := store, restarts, auditLog
+	t.Cleanup(func() {
+		restarts.mu.Lock()
+		if restarts.timer != nil {
+			restarts.timer.Stop()
+		}
+		restarts.mu.Unlock()
+		for i, f := range files {
+			*f = saved[i]
+		}
+		store, restarts, auditLog = savedStore, savedRestarts, savedAudit
+	})
+
+	ConfigFile = filepath.Join(dir, "config.json")
+	UserDB = filepath.Join(dir, "users.json")
+	JournalFile = filepath.Join(dir, "journal.json")
+	TelegramMappingsFile = filepath.Join(dir, "telegram_mappings.json")
+	store = &jsonUserStorage{path: UserDB}
+	restarts = &restartCoordinator{window: time.Hour}
+	auditLog = &auditLogger{path: filepath.Join(dir, "audit.log")}
+
+	var config Config
+	config.Auth.Mode = "passwords"
+	config.Auth.Config = auth
+	if err := saveConfig(config); err != nil {
+		t.Fatal(err)
+	}
+	if err := saveUsers(users); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// readTestState returns auth.config and the user database by password.
+func readTestState(t *testing.T) ([]string, map[string]UserStore) {
+	t.Helper()
+	config, err := loadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	users, err := loadUsers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	byPassword := make(map[string]UserStore)
+	for _, u := range users {
+		byPassword[u.Password] = u
+	}
+	return config.Auth.Config, byPassword
+}
+
+func testUser(password, status string) UserStore {
+	return UserStore{Password: password, Expired: "2099-01-01T00:00:00Z", Status: status}
+}
+
+func mustCIDRs(t *testing.T, values ...string) []*net.IPNet {
+	t.Helper()
+	nets, err := parseCIDRs(values)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return nets
+}
+
+func TestIPLimiterCheck(t *testing.T) {
+	type step struct {
+		advance time.Duration
+		class   string
+		ip      string
+		code    string // Empty when the request is allowed
+	}
+	tests := []struct {
+		name  string
+		steps []step
+	}{
+		{"burst then limited", []step{
+			{0, "write", "1.1.1.1", ""},
+			{0, "write", "1.1.1.1", ""},
+			{0, "write", "1.1.1.1", CodeRateLimited},
+		}},
+		{"refills one token per second", []step{
+			{0, "write", "1.1.1.1", ""},
+			{0, "write", "1.1.1.1", ""},
+			{500 * time.Millisecond, "write", "1.1.1.1", CodeRateLimited},
+			{500 * time.Millisecond, "write", "1.1.1.1", ""},
+			{0, "write", "1.1.1.1", CodeRateLimited},
+		}},
+		{"refill is capped at burst", []step{
+			{time.Hour, "write", "1.1.1.1", ""},
+			{0, "write", "1.1.1.1", ""},
+			{0, "write", "1.1.1.1", CodeRateLimited},
+		}},
+		{"buckets are per IP", []step{
+			{0, "write", "1.1.1.1", ""},
+			{0, "write", "1.1.1.1", ""},
+			{0, "write", "2.2.2.2", ""},
+		}},
+		{"classes without a limit are not limited", []step{
+			{0, "read", "1.1.1.1", ""},
+			{0, "read", "1.1.1.1", ""},
+			{0, "read", "1.1.1.1", ""},
+		}},
+		{"exempt networks are not limited", []step{
+			{0, "write", "10.0.0.1", ""},
+			{0, "write", "10.0.0.1", ""},
+			{0, "write", "10.0.0.1", ""},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l, clock := newTestLimiter(t)
+			l.exempt = mustCIDRs(t, "10.0.0.0/8")
+			for i, s := range tt.steps {
+				clock.Advance(s.advance)
+				err, wait := l.Check(s.class, s.ip)
+				code := ""
+				if err != nil {
+					code = err.Code
+				}
+				if code != s.code {
+					t.Fatalf("step %d: code = %q, want %q", i, code, s.code)
+				}
+				if code != "" && wait <= 0 {
+					t.Fatalf("step %d: wait = %v, want > 0", i, wait)
+				}
+			}
+		})
+	}
+}
+
+func TestIPLimiterFailure(t *testing.T) {
+	tests := []struct {
+		name   string
+		ip     string
+		gaps   []time.Duration // Time before each failure
+		banned bool
+	}{
+		{"below threshold", "1.1.1.1", []time.Duration{0, time.Second}, false},
+		{"threshold within window", "1.1.1.1", []time.Duration{0, 20 * time.Second, 20 * time.Second}, true},
+		{"failures outside window expire", "1.1.1.1", []time.Duration{0, 40 * time.Second, 40 * time.Second}, false},
+		{"exempt networks are never banned", "10.0.0.1", []time.Duration{0, 0, 0, 0}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l, clock := newTestLimiter(t)
+			l.exempt = mustCIDRs(t, "10.0.0.0/8")
+			for _, gap := range tt.gaps {
+				clock.Advance(gap)
+				l.Failure(tt.ip)
+			}
+			err, _ := l.Check("public", tt.ip)
+			if banned := err != nil && err.Code == CodeIPBanned; banned != tt.banned {
+				t.Fatalf("banned = %v, want %v (err %v)", banned, tt.banned, err)
+			}
+		})
+	}
+}
+
+func TestIPLimiterBanExpires(t *testing.T) {
+	l, clock := newTestLimiter(t)
+	for i := 0; i < l.banThreshold; i++ {
+		l.Failure("1.1.1.1")
+	}
+
+	clock.Advance(l.banDuration - time.Second)
+	if err, wait := l.Check("public", "1.1.1.1"); err == nil || err.Code != CodeIPBanned || wait != time.Second {
+		t.Fatalf("before expiry: err %v, wait %v", err, wait)
+	}
+	if got := len(l.Bans()); got != 1 {
+		t.Fatalf("Bans() = %d entries, want 1", got)
+	}
+
+	clock.Advance(time.Second)
+	if err, _ := l.Check("public", "1.1.1.1"); err != nil {
+		t.Fatalf("after expiry: err %v", err)
+	}
+	if got := len(l.Bans()); got != 0 {
+		t.Fatalf("Bans() = %d entries, want 0", got)
+	}
+}
+
+func TestIPLimiterPrune(t *testing.T) {
+	tests := []struct {
+		name                    string
+		advance                 time.Duration
+		buckets, failures, bans int
+	}{
+		{"nothing has aged", 0, 1, 1, 1},
+		{"bucket refilled", 2 * time.Second, 0, 1, 1},
+		{"failures left the window", time.Minute, 0, 0, 1},
+		{"ban expired", 10 * time.Minute, 0, 0, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l, clock := newTestLimiter(t)
+			l.Check("write", "1.1.1.1")
+			l.Failure("2.2.2.2")
+			for i := 0; i < l.banThreshold; i++ {
+				l.Failure("3.3.3.3")
+			}
+
+			clock.Advance(tt.advance)
+			l.prune()
+			if len(l.buckets) != tt.buckets || len(l.failures) != tt.failures || len(l.bans) != tt.bans {
+				t.Fatalf("buckets %d, failures %d, bans %d; want %d, %d, %d",
+					len(l.buckets), len(l.failures), len(l.bans), tt.buckets, tt.failures, tt.bans)
+			}
+		})
+	}
+}
+
+func TestRemoteIP(t *testing.T) {
+	saved := trustedProxies
+	trustedProxies = mustCIDRs(t, "10.0.0.0/8", "::1")
+	defer func() { trustedProxies = saved }()
+
+	tests := []struct {
+		name   string
+		remote string
+		xff    []string
+		want   string
+	}{
+		{"direct client", "203.0.113.5:1234", nil, "203.0.113.5"},
+		{"untrusted peer cannot forge", "203.0.113.5:1234", []string{"1.2.3.4"}, "203.0.113.5"},
+		{"trusted proxy without header", "10.0.0.1:1234", nil, "10.0.0.1"},
+		{"trusted proxy", "10.0.0.1:1234", []string{"198.51.100.7"}, "198.51.100.7"},
+		{"forged left-most hop is ignored", "10.0.0.1:1234", []string{"1.2.3.4, 198.51.100.7"}, "198.51.100.7"},
+		{"chain of trusted proxies", "10.0.0.1:1234", []string{"1.2.3.4, 198.51.100.7, 10.0.0.2"}, "198.51.100.7"},
+		{"header split over lines", "10.0.0.1:1234", []string{"1.2.3.4", "198.51.100.7, 10.0.0.2"}, "198.51.100.7"},
+		{"garbage hop stops the walk", "10.0.0.1:1234", []string{"198.51.100.7, bogus"}, "10.0.0.1"},
+		{"garbage behind the client", "10.0.0.1:1234", []string{"bogus, 198.51.100.7"}, "198.51.100.7"},
+		{"only trusted hops", "10.0.0.1:1234", []string{"10.0.0.3, 10.0.0.2"}, "10.0.0.3"},
+		{"IPv6 proxy", "[::1]:1234", []string{"2001:db8::1"}, "2001:db8::1"},
+		{"remote without port", "203.0.113.5", nil, "203.0.113.5"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &http.Request{RemoteAddr: tt.remote, Header: http.Header{}}
+			for _, v := range tt.xff {
+				r.Header.Add("X-Forwarded-For", v)
+			}
+			if got := remoteIP(r); got != tt.want {
+				t.Fatalf("remoteIP = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestApiKeyAllowsIP(t *testing.T) {
+	tests := []struct {
+		name    string
+		allowed []string
+		ip      string
+		want    bool
+	}{
+		{"no allowlist", nil, "203.0.113.5", true},
+		{"plain IP", []string{"203.0.113.5"}, "203.0.113.5", true},
+		{"other IP", []string{"203.0.113.5"}, "203.0.113.6", false},
+		{"CIDR", []string{"203.0.113.0/24"}, "203.0.113.200", true},
+		{"outside CIDR", []string{"203.0.113.0/24"}, "203.0.114.1", false},
+		{"IPv6", []string{"2001:db8::/32"}, "2001:db8::1", true},
+		{"invalid entry denies", []string{"203.0.113.5", "bogus"}, "203.0.113.5", false},
+		{"unparsable client", []string{"203.0.113.0/24"}, "bogus", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			k := ApiKey{ID: "test", AllowedIPs: tt.allowed}
+			if got := k.allowsIP(tt.ip); got != tt.want {
+				t.Fatalf("allowsIP(%q) = %v, want %v", tt.ip, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseCronSchedule(t *testing.T) {
+	tests := []struct {
+		spec string
+		ok   bool
+	}{
+		{"* * * * *", true},
+		{"*/5 0-6 1,15 * 1-5", true},
+		{"0 0 29 2 *", true},
+		{"0 0 31 2 1", true}, // Weekday alone can match
+		{"* * * *", false},
+		{"* * * * * *", false},
+		{"60 * * * *", false},
+		{"* 24 * * *", false},
+		{"* * 0 * *", false},
+		{"* * * 13 *", false},
+		{"* * * * 7", false},
+		{"5-1 * * * *", false},
+		{"*/0 * * * *", false},
+		{"a * * * *", false},
+		{"0 0 31 2 *", false},
+		{"0 0 30,31 2 *", false},
+		{"0 0 31 4,6,9,11 *", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.spec, func(t *testing.T) {
+			_, err := parseCronSchedule(tt.spec)
+			if (err == nil) != tt.ok {
+				t.Fatalf("parseCronSchedule(%q) err = %v, want ok %v", tt.spec, err, tt.ok)
+			}
+		})
+	}
+}
+
+func TestCronScheduleNext(t *testing.T) {
+	jakarta, err := time.LoadLocation("Asia/Jakarta")
+	if err != nil {
+		t.Skip(err)
+	}
+	newYork, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skip(err)
+	}
+	santiago, err := time.LoadLocation("America/Santiago")
+	if err != nil {
+		t.Skip(err)
+	}
+
+	tests := []struct {
+		name string
+		spec string
+		from time.Time
+		want time.Time
+	}{
+		{"next minute", "* * * * *",
+			time.Date(2025, 1, 1, 12, 0, 30, 0, time.UTC),
+			time.Date(2025, 1, 1, 12, 1, 0, 0, time.UTC)},
+		{"strictly after", "0 * * * *",
+			time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC),
+			time.Date(2025, 1, 1, 13, 0, 0, 0, time.UTC)},
+		{"step", "*/15 * * * *",
+			time.Date(2025, 1, 1, 12, 16, 0, 0, time.UTC),
+			time.Date(2025, 1, 1, 12, 30, 0, 0, time.UTC)},
+		{"rolls over the year", "0 0 1 1 *",
+			time.Date(2025, 6, 1, 0, 0, 0, 0, time.UTC),
+			time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{"leap day", "0 0 29 2 *",
+			time.Date(2025, 3, 1, 0, 0, 0, 0, time.UTC),
+			time.Date(2028, 2, 29, 0, 0, 0, 0, time.UTC)},
+		{"day of month only", "0 0 13 * *",
+			time.Date(2025, 6, 1, 0, 0, 0, 0, time.UTC),
+			time.Date(2025, 6, 13, 0, 0, 0, 0, time.UTC)},
+		{"weekday only", "0 0 * * 5",
+			time.Date(2025, 6, 1, 0, 0, 0, 0, time.UTC), // Sunday
+			time.Date(2025, 6, 6, 0, 0, 0, 0, time.UTC)},
+		{"day of month or weekday, weekday first", "0 0 13 * 5",
+			time.Date(2025, 6, 1, 0, 0, 0, 0, time.UTC),
+			time.Date(2025, 6, 6, 0, 0, 0, 0, time.UTC)},
+		{"day of month or weekday, day first", "0 0 13 * 5",
+			time.Date(2025, 6, 10, 0, 0, 0, 0, time.UTC), // Tuesday
+			time.Date(2025, 6, 13, 0, 0, 0, 0, time.UTC)},
+		{"day of month or weekday, impossible day", "0 0 31 2 1",
+			time.Date(2025, 2, 1, 0, 0, 0, 0, time.UTC),
+			time.Date(2025, 2, 3, 0, 0, 0, 0, time.UTC)},
+		{"stepped day of month is restricted", "0 0 */10 * 0",
+			time.Date(2025, 6, 2, 0, 0, 0, 0, time.UTC),
+			time.Date(2025, 6, 8, 0, 0, 0, 0, time.UTC)},
+		{"in the schedule's timezone", "0 2 * * *",
+			time.Date(2025, 1, 1, 18, 0, 0, 0, time.UTC).In(jakarta), // 01:00 WIB
+			time.Date(2025, 1, 2, 2, 0, 0, 0, jakarta)},
+		{"skips a time lost to DST", "30 2 * * *",
+			time.Date(2025, 3, 9, 0, 0, 0, 0, newYork),
+			time.Date(2025, 3, 10, 2, 30, 0, 0, newYork)},
+		{"next hour lost to DST", "0 3 * * *",
+			time.Date(2025, 3, 9, 1, 30, 0, 0, newYork),
+			time.Date(2025, 3, 9, 3, 0, 0, 0, newYork)},
+		{"midnight lost to DST", "0 * * * *",
+			time.Date(2025, 9, 6, 23, 30, 0, 0, santiago),
+			time.Date(2025, 9, 7, 1, 0, 0, 0, santiago)},
+		{"across DST", "0 12 * * *",
+			time.Date(2025, 3, 8, 13, 0, 0, 0, newYork),
+			time.Date(2025, 3, 9, 12, 0, 0, 0, newYork)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := parseCronSchedule(tt.spec)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := c.Next(tt.from)
+			if !got.Equal(tt.want) {
+				t.Fatalf("Next(%s) = %s, want %s", tt.from, got, tt.want)
+			}
+			if got.Location() != tt.from.Location() {
+				t.Fatalf("Next location = %s, want %s", got.Location(), tt.from.Location())
+			}
+		})
+	}
+}
+
+func TestJournalRecovery(t *testing.T) {
+	a, b, c := testUser("usera", "active"), testUser("userb", "active"), testUser("userc", "active")
+	lockedB := b
+	lockedB.Status = "locked"
+	tests := []struct {
+		name     string
+		auth     []string // On disk when the API stopped
+		users    []UserStore
+		changes  []journalChange
+		recovery string
+		wantAuth []string
+		wantDB   []string
+	}{
+		{"create rolled back after config write",
+			[]string{"usera", "userc"}, []UserStore{a},
+			[]journalChange{{Password: "userc", After: journalState{InConfig: true, User: &c}}},
+			"rollback", []string{"usera"}, []string{"usera"}},
+		{"create rolled forward after config write",
+			[]string{"usera", "userc"}, []UserStore{a},
+			[]journalChange{{Password: "userc", After: journalState{InConfig: true, User: &c}}},
+			"forward", []string{"usera", "userc"}, []string{"usera", "userc"}},
+		{"delete rolled back after config write",
+			[]string{"usera"}, []UserStore{a, b},
+			[]journalChange{{Password: "userb", Before: journalState{InConfig: true, User: &b}}},
+			"", []string{"usera", "userb"}, []string{"usera", "userb"}},
+		{"delete rolled forward after config write",
+			[]string{"usera"}, []UserStore{a, b},
+			[]journalChange{{Password: "userb", Before: journalState{InConfig: true, User: &b}}},
+			"forward", []string{"usera"}, []string{"usera"}},
+		{"lock rolled back before any write",
+			[]string{"usera", "userb"}, []UserStore{a, b},
+			[]journalChange{{Password: "userb", Before: journalState{InConfig: true, User: &b}, After: journalState{User: &lockedB}}},
+			"rollback", []string{"usera", "userb"}, []string{"usera", "userb"}},
+		{"bulk rolled forward is idempotent",
+			[]string{"usera", "userc"}, []UserStore{a, c},
+			[]journalChange{
+				{Password: "userb", Before: journalState{InConfig: true, User: &b}},
+				{Password: "userc", After: journalState{InConfig: true, User: &c}},
+			},
+			"forward", []string{"usera", "userc"}, []string{"usera", "userc"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			newTestState(t, tt.auth, tt.users...)
+			if err := beginMutation("test", tt.changes...); err != nil {
+				t.Fatal(err)
+			}
+
+			checkIntegrity(ApiConfig{JournalRecovery: tt.recovery})
+
+			if _, err := os.Stat(JournalFile); !os.IsNotExist(err) {
+				t.Fatalf("journal still on disk after recovery: %v", err)
+			}
+			auth, users := readTestState(t)
+			if !reflect.DeepEqual(auth, tt.wantAuth) {
+				t.Fatalf("auth.config = %v, want %v", auth, tt.wantAuth)
+			}
+			if len(users) != len(tt.wantDB) {
+				t.Fatalf("database = %v, want %v", users, tt.wantDB)
+			}
+			for _, p := range tt.wantDB {
+				if _, ok := users[p]; !ok {
+					t.Fatalf("database = %v, want %v", users, tt.wantDB)
+				}
+			}
+			for _, ch := range tt.changes {
+				want := ch.Before.User
+				if tt.recovery == "forward" {
+					want = ch.After.User
+				}
+				if got, ok := users[ch.Password]; want != nil && (!ok || got.Status != want.Status) {
+					t.Fatalf("%s status = %q, want %q", ch.Password, got.Status, want.Status)
+				}
+			}
+		})
+	}
+}
+
+func TestBeginMutationRefusesLeftoverJournal(t *testing.T) {
+	newTestState(t, nil)
+	if err := beginMutation("first"); err != nil {
+		t.Fatal(err)
+	}
+	if err := beginMutation("second"); err == nil {
+		t.Fatal("beginMutation over an unresolved journal succeeded")
+	}
+	commitMutation()
+	if err := beginMutation("third"); err != nil {
+		t.Fatalf("beginMutation after commit: %v", err)
+	}
+}
+
+// errCode returns the API error code of err, or its text for other errors.
+func errCode(err error) string {
+	if err == nil {
+		return ""
+	}
+	if apiErr, ok := err.(*apiError); ok {
+		return apiErr.Code
+	}
+	return err.Error()
+}
+
+func TestMutationSetApply(t *testing.T) {
+	now := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+	a := testUser("usera", "active")
+	b := testUser("userb", "locked")
+	b.LockReason, b.LockedUntil = "old", "2025-01-02T00:00:00Z"
+	op := func(name, password string) BulkOperation {
+		return BulkOperation{Op: name, UserRequest: UserRequest{Password: password}}
+	}
+	withDays := func(o BulkOperation, days int) BulkOperation {
+		o.Days = days
+		return o
+	}
+
+	tests := []struct {
+		name     string
+		ops      []BulkOperation
+		wantErrs []string // Error code per operation
+		wantAuth []string
+		want     map[string]string // Status by password, "" when deleted
+		check    func(t *testing.T, users map[string]UserStore)
+	}{
+		{"create adds to auth.config",
+			[]BulkOperation{withDays(op("create", "userc"), 1)},
+			[]string{""}, []string{"usera", "userc"},
+			map[string]string{"userc": "active"}, nil},
+		{"create without duration",
+			[]BulkOperation{op("create", "userc")},
+			[]string{CodeValidation}, []string{"usera"},
+			map[string]string{"userc": ""}, nil},
+		{"create over an existing user",
+			[]BulkOperation{withDays(op("create", "userb"), 1)},
+			[]string{CodeUserExists}, []string{"usera"},
+			map[string]string{"userb": "locked"}, nil},
+		{"create then delete in one batch",
+			[]BulkOperation{withDays(op("create", "userc"), 1), op("delete", "userc")},
+			[]string{"", ""}, []string{"usera"},
+			map[string]string{"userc": ""}, nil},
+		{"renew unlocks and clears the lock",
+			[]BulkOperation{withDays(op("renew", "userb"), 1)},
+			[]string{""}, []string{"usera", "userb"},
+			map[string]string{"userb": "active"},
+			func(t *testing.T, users map[string]UserStore) {
+				if u := users["userb"]; u.LockReason != "" || u.LockedUntil != "" {
+					t.Fatalf("lock fields kept after renew: %+v", u)
+				}
+			}},
+		{"renew unknown user",
+			[]BulkOperation{withDays(op("renew", "nobody"), 1)},
+			[]string{CodeUserNotFound}, []string{"usera"},
+			nil, nil},
+		{"lock with reason and duration",
+			[]BulkOperation{{Op: "lock", UserRequest: UserRequest{Password: "usera", Hours: 2}, Reason: " telat "}},
+			[]string{""}, []string{},
+			map[string]string{"usera": "locked"},
+			func(t *testing.T, users map[string]UserStore) {
+				if u := users["usera"]; u.LockReason != "telat" || u.LockedUntil != "2025-01-01T14:00:00Z" {
+					t.Fatalf("lock fields = %q, %q", u.LockReason, u.LockedUntil)
+				}
+			}},
+		{"lock without fields replaces a timed lock",
+			[]BulkOperation{op("lock", "userb")},
+			[]string{""}, []string{"usera"},
+			map[string]string{"userb": "locked"},
+			func(t *testing.T, users map[string]UserStore) {
+				if u := users["userb"]; u.LockReason != "" || u.LockedUntil != "" {
+					t.Fatalf("old lock fields kept: %+v", u)
+				}
+			}},
+		{"lock with until in the past",
+			[]BulkOperation{{Op: "lock", UserRequest: UserRequest{Password: "usera"}, Until: "2024-12-31T00:00:00Z"}},
+			[]string{CodeValidation}, []string{"usera"},
+			map[string]string{"usera": "active"}, nil},
+		{"unlock a locked user",
+			[]BulkOperation{op("unlock", "userb")},
+			[]string{""}, []string{"usera", "userb"},
+			map[string]string{"userb": "active"}, nil},
+		{"unlock an active user",
+			[]BulkOperation{op("unlock", "usera")},
+			[]string{CodeUserNotLocked}, []string{"usera"},
+			map[string]string{"usera": "active"}, nil},
+		{"unknown operation",
+			[]BulkOperation{op("rename", "usera")},
+			[]string{CodeValidation}, []string{"usera"},
+			map[string]string{"usera": "active"}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var config Config
+			config.Auth.Config = []string{"usera"}
+			set := newMutationSet(config, []UserStore{a, b})
+			for i, o := range tt.ops {
+				_, _, err := set.Apply(o, now)
+				if got := errCode(err); got != tt.wantErrs[i] {
+					t.Fatalf("op %d (%s) error = %q, want %q", i, o.Op, got, tt.wantErrs[i])
+				}
+			}
+
+			if auth := set.Auth(); !reflect.DeepEqual(auth, tt.wantAuth) {
+				t.Fatalf("auth = %v, want %v", auth, tt.wantAuth)
+			}
+			users := make(map[string]UserStore)
+			for _, u := range set.Users() {
+				users[u.Password] = u
+			}
+			for p, status := range tt.want {
+				if got := users[p].Status; got != status {
+					t.Fatalf("%s status = %q, want %q", p, got, status)
+				}
+			}
+			if tt.check != nil {
+				tt.check(t, users)
+			}
+		})
+	}
+}
+
+func TestBulkUsers(t *testing.T) {
+	tests := []struct {
+		name       string
+		body       string
+		wantStatus int
+		wantAuth   []string
+		wantDB     []string
+	}{
+		{"atomic applies a valid batch",
+			`{"operations":[{"op":"create","password":"userc","days":1},{"op":"lock","password":"usera"}]}`,
+			http.StatusOK, []string{"userc"}, []string{"usera", "userb", "userc"}},
+		{"atomic rejects the batch on one invalid operation",
+			`{"mode":"atomic","operations":[{"op":"create","password":"userc","days":1},{"op":"unlock","password":"usera"}]}`,
+			http.StatusBadRequest, []string{"usera"}, []string{"usera", "userb"}},
+		{"best effort applies the valid operations",
+			`{"mode":"best_effort","operations":[{"op":"create","password":"userc","days":1},{"op":"unlock","password":"usera"},{"op":"delete","password":"userb"}]}`,
+			http.StatusOK, []string{"usera", "userc"}, []string{"usera", "userc"}},
+		{"best effort with nothing valid changes nothing",
+			`{"mode":"best_effort","operations":[{"op":"renew","password":"nobody","days":1}]}`,
+			http.StatusOK, []string{"usera"}, []string{"usera", "userb"}},
+		{"unknown mode",
+			`{"mode":"some","operations":[{"op":"delete","password":"usera"}]}`,
+			http.StatusBadRequest, []string{"usera"}, []string{"usera", "userb"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			newTestState(t, []string{"usera"}, testUser("usera", "active"), testUser("userb", "locked"))
+
+			w := httptest.NewRecorder()
+			bulkUsers(w, httptest.NewRequest(http.MethodPost, "/api/v1/users/bulk", strings.NewReader(tt.body)))
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+			var resp Response
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+				t.Fatal(err)
+			}
+			if resp.Success != (tt.wantStatus == http.StatusOK) {
+				t.Fatalf("success = %v: %s", resp.Success, w.Body)
+			}
+
+			auth, users := readTestState(t)
+			if !reflect.DeepEqual(auth, tt.wantAuth) {
+				t.Fatalf("auth.config = %v, want %v", auth, tt.wantAuth)
+			}
+			if len(users) != len(tt.wantDB) {
+				t.Fatalf("database = %v, want %v", users, tt.wantDB)
+			}
+			for _, p := range tt.wantDB {
+				if _, ok := users[p]; !ok {
+					t.Fatalf("database = %v, want %v", users, tt.wantDB)
+				}
+			}
+			if _, err := os.Stat(JournalFile); !os.IsNotExist(err) {
+				t.Fatalf("journal left after bulk: %v", err)
+			}
+		})
+	}
+}
+
+func TestRenameUser(t *testing.T) {
+	tests := []struct {
+		name         string
+		body         string
+		wantStatus   int
+		wantAuth     []string
+		wantMappings map[string]string
+	}{
+		{"active user keeps its place in auth.config",
+			`{"password":"userb","new_password":"newb"}`,
+			http.StatusOK, []string{"usera", "newb", "userc"},
+			map[string]string{"111": "newb", "222": "usera"}},
+		{"locked user stays out of auth.config",
+			`{"password":"userd","new_password":"newd"}`,
+			http.StatusOK, []string{"usera", "userb", "userc"},
+			map[string]string{"111": "userb", "222": "usera"}},
+		{"new password already taken",
+			`{"password":"userb","new_password":"userc"}`,
+			http.StatusConflict, []string{"usera", "userb", "userc"},
+			map[string]string{"111": "userb", "222": "usera"}},
+		{"unknown user",
+			`{"password":"nobody","new_password":"newb"}`,
+			http.StatusNotFound, []string{"usera", "userb", "userc"},
+			map[string]string{"111": "userb", "222": "usera"}},
+		{"invalid new password",
+			`{"password":"userb","new_password":"a b"}`,
+			http.StatusBadRequest, []string{"usera", "userb", "userc"},
+			map[string]string{"111": "userb", "222": "usera"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := testUser("userb", "active")
+			b.Owner, b.Note, b.Tags = "111", "vip", []string{"promo"}
+			d := testUser("userd", "locked")
+			d.Owner = "111"
+			newTestState(t, []string{"usera", "userb", "userc"},
+				testUser("usera", "active"), b, testUser("userc", "active"), d)
+			if err := ioutil.WriteFile(TelegramMappingsFile, []byte(`{"111":"userb","222":"usera"}`), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			var req RenameRequest
+			if err := json.Unmarshal([]byte(tt.body), &req); err != nil {
+				t.Fatal(err)
+			}
+			before, _, _ := store.Get(req.Password)
+
+			w := httptest.NewRecorder()
+			renameUser(w, httptest.NewRequest(http.MethodPost, "/api/v1/user/rename", strings.NewReader(tt.body)))
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+
+			auth, users := readTestState(t)
+			if !reflect.DeepEqual(auth, tt.wantAuth) {
+				t.Fatalf("auth.config = %v, want %v", auth, tt.wantAuth)
+			}
+			if tt.wantStatus == http.StatusOK {
+				if _, ok := users[req.Password]; ok {
+					t.Fatalf("%s still in the database", req.Password)
+				}
+				after, ok := users[req.NewPassword]
+				if !ok {
+					t.Fatalf("%s not in the database", req.NewPassword)
+				}
+				if after.Owner != before.Owner || after.Note != before.Note || !reflect.DeepEqual(after.Tags, before.Tags) ||
+					after.Status != before.Status || after.Expired != before.Expired {
+					t.Fatalf("record after rename = %+v, want the fields of %+v", after, before)
+				}
+			} else if len(users) != 4 {
+				t.Fatalf("database changed on a failed rename: %v", users)
+			}
+
+			data, err := ioutil.ReadFile(TelegramMappingsFile)
+			if err != nil {
+				t.Fatal(err)
+			}
+			mappings := make(map[string]string)
+			if err := json.Unmarshal(data, &mappings); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(mappings, tt.wantMappings) {
+				t.Fatalf("telegram mappings = %v, want %v", mappings, tt.wantMappings)
+			}
+		})
+	}
+}
+
+func TestRenameTelegramMappingsWithoutFile(t *testing.T) {
+	newTestState(t, nil)
+	if err := renameTelegramMappings("usera", "newa"); err != nil {
+		t.Fatalf("renameTelegramMappings without a file: %v", err)
+	}
+	if _, err := os.Stat(TelegramMappingsFile); !os.IsNotExist(err) {
+		t.Fatalf("mappings file created: %v", err)
+	}
+}
+
+func TestReconcile(t *testing.T) {
+	expired := testUser("usere", "active")
+	expired.Expired = "2000-01-01T00:00:00Z"
+	drifted := func(t *testing.T) {
+		newTestState(t, []string{"usera", "usera", "ghost", "userl", "usere"},
+			testUser("usera", "active"), testUser("userl", "locked"), expired, testUser("userm", "active"))
+	}
+	clean := func(t *testing.T) {
+		newTestState(t, []string{"usera"}, testUser("usera", "active"), testUser("userl", "locked"))
+	}
+
+	tests := []struct {
+		name          string
+		setup         func(t *testing.T)
+		apply         bool
+		removeOrphans bool
+		wantTypes     []string
+		wantFixed     int
+		wantRestart   string
+		wantAuth      []string
+	}{
+		{"dry run changes nothing", drifted, false, false,
+			[]string{"duplicate_in_config", "missing_record", "locked_in_config", "expired_in_config", "missing_in_config"},
+			0, "", []string{"usera", "usera", "ghost", "userl", "usere"}},
+		{"apply keeps orphans by default", drifted, true, false,
+			[]string{"duplicate_in_config", "missing_record", "locked_in_config", "expired_in_config", "missing_in_config"},
+			4, RestartPending, []string{"usera", "ghost", "userm"}},
+		{"apply removes orphans on request", drifted, true, true,
+			[]string{"duplicate_in_config", "missing_record", "locked_in_config", "expired_in_config", "missing_in_config"},
+			5, RestartPending, []string{"usera", "userm"}},
+		{"apply on a clean state", clean, true, true,
+			[]string{}, 0, "", []string{"usera"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.setup(t)
+
+			report, err := reconcile(tt.apply, tt.removeOrphans)
+			if err != nil {
+				t.Fatal(err)
+			}
+			types := []string{}
+			for _, d := range report.Discrepancies {
+				types = append(types, d.Type)
+			}
+			if !reflect.DeepEqual(types, tt.wantTypes) {
+				t.Fatalf("discrepancies = %v, want %v", types, tt.wantTypes)
+			}
+			if report.Applied != tt.apply || report.Fixed != tt.wantFixed || report.Restart != tt.wantRestart {
+				t.Fatalf("applied, fixed, restart = %v, %d, %q, want %v, %d, %q",
+					report.Applied, report.Fixed, report.Restart, tt.apply, tt.wantFixed, tt.wantRestart)
+			}
+			auth, _ := readTestState(t)
+			if !reflect.DeepEqual(auth, tt.wantAuth) {
+				t.Fatalf("auth.config = %v, want %v", auth, tt.wantAuth)
+			}
+		})
+	}
+}
+
+func TestParseExpiry(t *testing.T) {
+	wib := time.FixedZone("WIB", 7*60*60)
+	saved := time.Local
+	time.Local = wib
+	t.Cleanup(func() { time.Local = saved })
+
+	tests := []struct {
+		name    string
+		expired string
+		want    time.Time
+		format  string // formatExpiry result, the input when unreadable
+		wantErr bool
+	}{
+		{"RFC3339", "2025-06-01T10:30:00Z", time.Date(2025, 6, 1, 10, 30, 0, 0, time.UTC), "2025-06-01T10:30:00Z", false},
+		{"RFC3339 with offset", "2025-06-01T10:30:00+07:00", time.Date(2025, 6, 1, 3, 30, 0, 0, time.UTC), "2025-06-01T10:30:00+07:00", false},
+		{"date only lasts the whole local day", "2025-06-01", time.Date(2025, 6, 2, 0, 0, 0, 0, wib), "2025-06-02T00:00:00+07:00", false},
+		{"date only at the end of a month", "2025-01-31", time.Date(2025, 2, 1, 0, 0, 0, 0, wib), "2025-02-01T00:00:00+07:00", false},
+		{"date only at the end of a year", "2024-12-31", time.Date(2025, 1, 1, 0, 0, 0, 0, wib), "2025-01-01T00:00:00+07:00", false},
+		{"date only on a leap day", "2024-02-29", time.Date(2024, 3, 1, 0, 0, 0, 0, wib), "2024-03-01T00:00:00+07:00", false},
+		{"invalid date", "2025-02-30", time.Time{}, "2025-02-30", true},
+		{"empty", "", time.Time{}, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseExpiry(tt.expired)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseExpiry(%q) error = %v, wantErr %v", tt.expired, err, tt.wantErr)
+			}
+			if f := formatExpiry(tt.expired); f != tt.format {
+				t.Fatalf("formatExpiry(%q) = %q, want %q", tt.expired, f, tt.format)
+			}
+			if tt.wantErr {
+				if isExpired(UserStore{Expired: tt.expired}, time.Now()) {
+					t.Fatalf("unreadable expiry %q treated as expired", tt.expired)
+				}
+				return
+			}
+			if !got.Equal(tt.want) {
+				t.Fatalf("parseExpiry(%q) = %s, want %s", tt.expired, got, tt.want)
+			}
+			u := UserStore{Expired: tt.expired}
+			if isExpired(u, tt.want.Add(-time.Second)) {
+				t.Fatalf("%q expired a second before %s", tt.expired, tt.want)
+			}
+			if !isExpired(u, tt.want) {
+				t.Fatalf("%q not expired at %s", tt.expired, tt.want)
+			}
+		})
+	}
+}
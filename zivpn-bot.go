@@ -3,12 +3,21 @@ package main
 import (
 	"archive/zip"
 	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
 	"encoding/json"
+	"encoding/pem"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
+	"mime"
 	"net/http"
+	"net/url"
 	"os"
 	"os/exec"
 	"path/filepath"
@@ -28,20 +37,36 @@ const (
 	BotConfigFile          = "/etc/zivpn/bot-config.json"
 	ApiPortFile            = "/etc/zivpn/api_port"
 	ApiKeyFile             = "/etc/zivpn/apikey"
+	LegacySigningFile      = "/etc/zivpn/apikey.signing"
 	DomainFile             = "/etc/zivpn/domain"
 	PortFile               = "/etc/zivpn/port"
 	TelegramMappingsFile   = "/etc/zivpn/telegram_mappings.json" // <--- BARU
 )
 
-var ApiUrl = "http://127.0.0.1:" + PortFile + "/api"
+var ApiUrl = "http://127.0.0.1:" + PortFile + "/api/v1"
 
 var ApiKey = "AutoFtBot-agskjgdvsbdreiWG1234512SDKrqw"
 
+var ApiKeyID = "legacy"
+var SignRequests = false
+var SigningSecret = ""
+
+var apiClient = &http.Client{}
+
 type BotConfig struct {
 	BotToken string `json:"bot_token"`
 	AdminID  int64  `json:"admin_id"`
 	Mode     string `json:"mode"`   // "public" or "private"
 	Domain   string `json:"domain"` // Domain from setup
+	// SignRequests sends HMAC-signed API requests instead of X-API-Key
+	SignRequests bool   `json:"sign_requests"`
+	ApiKeyID     string `json:"api_key_id"` // Key ID for signing, defaults to "legacy"
+	// ApiSigningSecret is the signing_secret returned with api_key_id.
+	// The legacy key's secret is read from LegacySigningFile.
+	ApiSigningSecret string `json:"api_signing_secret"`
+	// ApiTLS talks HTTPS to the API, pinning the cert in ApiCertFile
+	ApiTLS      bool   `json:"api_tls"`
+	ApiCertFile string `json:"api_cert_file"` // Defaults to /etc/zivpn/zivpn.crt
 }
 
 type IpInfo struct {
@@ -54,7 +79,7 @@ type UserData struct {
 	Password string `json:"password"`
 	Expired  string `json:"expired"`
 	Status   string `json:"status"`
-	IpLimit  int    `json:"ip_limit"`
+	Owner    string `json:"owner"`
 }
 
 // ==========================================
@@ -79,7 +104,7 @@ func main() {
 	// Load API Port
 	if portBytes, err := ioutil.ReadFile(ApiPortFile); err == nil {
 		port := strings.TrimSpace(string(portBytes))
-		ApiUrl = fmt.Sprintf("http://127.0.0.1:%s/api", port)
+		ApiUrl = fmt.Sprintf("http://127.0.0.1:%s/api/v1", port)
 	}
 
 	// Load Config
@@ -87,6 +112,29 @@ func main() {
 	if err != nil {
 		log.Fatal("Gagal memuat konfigurasi bot:", err)
 	}
+	SignRequests = config.SignRequests
+	if config.ApiKeyID != "" {
+		ApiKeyID = config.ApiKeyID
+	}
+	if SignRequests {
+		SigningSecret = config.ApiSigningSecret
+		if SigningSecret == "" && ApiKeyID == "legacy" {
+			if secretBytes, err := ioutil.ReadFile(LegacySigningFile); err == nil {
+				SigningSecret = strings.TrimSpace(string(secretBytes))
+			}
+		}
+		if SigningSecret == "" {
+			log.Fatal("sign_requests aktif tapi signing secret tidak ditemukan (api_signing_secret atau ", LegacySigningFile, ")")
+		}
+	}
+	if config.ApiTLS {
+		ApiUrl = strings.Replace(ApiUrl, "http://", "https://", 1)
+		certFile := config.ApiCertFile
+		if certFile == "" {
+			certFile = "/etc/zivpn/zivpn.crt"
+		}
+		apiClient = newPinnedApiClient(certFile)
+	}
 
 	// Load telegram mappings  <--- BARU
 	if err := loadTelegramMappings(); err != nil {
@@ -318,6 +366,7 @@ func createUser(bot *tgbotapi.BotAPI, chatID int64, username string, days int, c
 	res, err := apiCall("POST", "/user/create", map[string]interface{}{
 		"password": username,
 		"days":     days,
+		"owner":    strconv.FormatInt(chatID, 10),
 	})
 
 	if err != nil {
@@ -330,6 +379,7 @@ func createUser(bot *tgbotapi.BotAPI, chatID int64, username string, days int, c
 		sendAccountInfo(bot, chatID, data, config)
 
 		// Simpan mapping Telegram ID -> Password
+		_ = loadTelegramMappings()
 		userAccounts[chatID] = username // chatID == userID di private chat
 		_ = saveTelegramMappings()
 	} else {
@@ -370,6 +420,7 @@ func deleteUser(bot *tgbotapi.BotAPI, chatID int64, username string, config *Bot
 
 	if res["success"] == true {
 		// Hapus mapping jika ada user yang akunnya dihapus
+		_ = loadTelegramMappings()
 		for uid, pass := range userAccounts {
 			if pass == username {
 				delete(userAccounts, uid)
@@ -465,7 +516,8 @@ func performBackup(bot *tgbotapi.BotAPI, chatID int64) {
 	// Files to backup
 	files := []string{
 		"/etc/zivpn/config.json",
-		"/etc/zivpn/users.json",
+		"/etc/zivpn/api-config.json",
+		"/etc/zivpn/apikeys.json",
 		"/etc/zivpn/domain",
 		TelegramMappingsFile, // <--- BARU
 	}
@@ -473,6 +525,17 @@ func performBackup(bot *tgbotapi.BotAPI, chatID int64) {
 	buf := new(bytes.Buffer)
 	zipWriter := zip.NewWriter(buf)
 
+	// Database user diambil lewat API. users.db tidak boleh disalin langsung
+	// selama API membukanya, hasilnya bisa rusak.
+	dbName, dbData, err := apiDownload("/backup/users")
+	if err != nil {
+		replyError(bot, chatID, "Gagal mengambil database user dari API: "+err.Error())
+		return
+	}
+	if w, err := zipWriter.Create(dbName); err == nil {
+		w.Write(dbData)
+	}
+
 	for _, file := range files {
 		if _, err := os.Stat(file); os.IsNotExist(err) {
 			continue
@@ -556,6 +619,9 @@ func processRestoreFile(bot *tgbotapi.BotAPI, msg *tgbotapi.Message, config *Bot
 	validFiles := map[string]bool{
 		"config.json":          true,
 		"users.json":           true,
+		"users.db":             true,
+		"api-config.json":      true,
+		"apikeys.json":         true,
 		"bot-config.json":      true,
 		"domain":               true,
 		"apikey":               true,
@@ -675,33 +741,51 @@ func sendAccountInfo(bot *tgbotapi.BotAPI, chatID int64, data map[string]interfa
 
 // <--- DIPERBAIKI: Admin tidak lagi diblokir oleh pesan peringatan
 func showExistingIfAny(bot *tgbotapi.BotAPI, chatID int64, userID int64, config *BotConfig) bool {
+	_ = loadTelegramMappings()
 	password := userAccounts[userID]
 	if password == "" {
 		return false
 	}
 
-	users, err := getUsers()
+	account, err := getUser(password)
 	if err != nil {
+		// Error sementara (rate limit, API down): mapping tetap disimpan
+		log.Printf("Gagal mengecek akun %s: %v", password, err)
 		return false
 	}
 
-	for _, u := range users {
-		if u.Password == password {
-			data := map[string]interface{}{
-				"password": u.Password,
-				"expired":  u.Expired,
+	// Password mungkin sudah diganti lewat /api/user/rename, cari lewat owner
+	if account == nil {
+		users, err := getUsers()
+		if err != nil {
+			return false
+		}
+		owner := strconv.FormatInt(userID, 10)
+		for i, u := range users {
+			if u.Owner == owner {
+				account = &users[i]
+				userAccounts[userID] = u.Password
+				_ = saveTelegramMappings()
+				break
 			}
-			sendAccountInfo(bot, chatID, data, config)
+		}
+	}
 
-			// Hanya tampilkan pesan peringatan untuk NON-ADMIN
-			if userID != config.AdminID {
-				sendMessage(bot, chatID, "⚠️ Anda sudah memiliki akun VPN. Untuk perubahan (renew/delete), hubungi admin.")
-				return true
-			}
+	if account != nil {
+		data := map[string]interface{}{
+			"password": account.Password,
+			"expired":  account.Expired,
+		}
+		sendAccountInfo(bot, chatID, data, config)
 
-			// Jika admin, cukup tampilkan info akun lalu lanjut ke menu utama
-			return false
+		// Hanya tampilkan pesan peringatan untuk NON-ADMIN
+		if userID != config.AdminID {
+			sendMessage(bot, chatID, "⚠️ Anda sudah memiliki akun VPN. Untuk perubahan (renew/delete), hubungi admin.")
+			return true
 		}
+
+		// Jika admin, cukup tampilkan info akun lalu lanjut ke menu utama
+		return false
 	}
 
 	// Jika akun tidak ditemukan di server, hapus mapping
@@ -865,10 +949,13 @@ func loadConfig() (BotConfig, error) {
 }
 
 // <--- BARU: Load & Save telegram mappings
+// API ikut mengubah file ini saat rename, jadi selalu dibaca ulang sebelum
+// mapping dipakai atau diubah.
 func loadTelegramMappings() error {
 	if data, err := ioutil.ReadFile(TelegramMappingsFile); err == nil {
 		var m map[string]string
 		if json.Unmarshal(data, &m) == nil {
+			userAccounts = make(map[int64]string)
 			for k, v := range m {
 				if id, err := strconv.ParseInt(k, 10, 64); err == nil {
 					userAccounts[id] = v
@@ -906,16 +993,21 @@ func apiCall(method, endpoint string, payload interface{}) (map[string]interface
 		}
 	}
 
-	client := &http.Client{}
 	req, err := http.NewRequest(method, ApiUrl+endpoint, bytes.NewBuffer(reqBody))
 	if err != nil {
 		return nil, err
 	}
 
 	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("X-API-Key", ApiKey)
+	if SignRequests {
+		if err := signApiRequest(req, reqBody); err != nil {
+			return nil, err
+		}
+	} else {
+		req.Header.Set("X-API-Key", ApiKey)
+	}
 
-	resp, err := client.Do(req)
+	resp, err := apiClient.Do(req)
 	if err != nil {
 		return nil, err
 	}
@@ -928,6 +1020,91 @@ func apiCall(method, endpoint string, payload interface{}) (map[string]interface
 	return result, nil
 }
 
+// apiDownload fetches a file from the API and returns the file name from
+// Content-Disposition together with its content.
+func apiDownload(endpoint string) (string, []byte, error) {
+	req, err := http.NewRequest(http.MethodGet, ApiUrl+endpoint, nil)
+	if err != nil {
+		return "", nil, err
+	}
+
+	if SignRequests {
+		if err := signApiRequest(req, nil); err != nil {
+			return "", nil, err
+		}
+	} else {
+		req.Header.Set("X-API-Key", ApiKey)
+	}
+
+	resp, err := apiClient.Do(req)
+	if err != nil {
+		return "", nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		var result map[string]interface{}
+		json.Unmarshal(body, &result)
+		return "", nil, fmt.Errorf("%v (%v)", result["message"], result["code"])
+	}
+
+	_, params, err := mime.ParseMediaType(resp.Header.Get("Content-Disposition"))
+	if err != nil || params["filename"] == "" {
+		return "", nil, fmt.Errorf("response %s tanpa nama file", endpoint)
+	}
+	return filepath.Base(params["filename"]), body, nil
+}
+
+// signApiRequest signs req for the API's signed-request mode, keyed with
+// the key's signing secret, so the key itself is never sent.
+func signApiRequest(req *http.Request, body []byte) error {
+	nonceBytes := make([]byte, 16)
+	if _, err := rand.Read(nonceBytes); err != nil {
+		return err
+	}
+	nonce := hex.EncodeToString(nonceBytes)
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+
+	bodyHash := sha256.Sum256(body)
+	mac := hmac.New(sha256.New, []byte(SigningSecret))
+	mac.Write([]byte(req.Method + "\n" + req.URL.RequestURI() + "\n" + timestamp + "\n" + nonce + "\n" + hex.EncodeToString(bodyHash[:])))
+
+	req.Header.Set("X-Key-ID", ApiKeyID)
+	req.Header.Set("X-Timestamp", timestamp)
+	req.Header.Set("X-Nonce", nonce)
+	req.Header.Set("X-Signature", hex.EncodeToString(mac.Sum(nil)))
+	return nil
+}
+
+// newPinnedApiClient trusts exactly the certificate in certFile. The API
+// cert is self-signed for the domain, so it is pinned instead of verified
+// against a CA and hostname. The file is re-read on every handshake so a
+// renewed cert keeps working.
+func newPinnedApiClient(certFile string) *http.Client {
+	return &http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{
+				InsecureSkipVerify: true,
+				VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+					pemBytes, err := ioutil.ReadFile(certFile)
+					if err != nil {
+						return err
+					}
+					block, _ := pem.Decode(pemBytes)
+					if block == nil || len(rawCerts) == 0 || !bytes.Equal(block.Bytes, rawCerts[0]) {
+						return fmt.Errorf("sertifikat API tidak cocok dengan %s", certFile)
+					}
+					return nil
+				},
+			},
+		},
+	}
+}
+
 func getIpInfo() (IpInfo, error) {
 	resp, err := http.Get("http://ip-api.com/json/")
 	if err != nil {
@@ -942,6 +1119,30 @@ func getIpInfo() (IpInfo, error) {
 	return info, nil
 }
 
+// getUser returns nil without an error only when the API answers
+// USER_NOT_FOUND. Any other failure, such as a rate limit or a server
+// error, is returned as an error so callers do not drop the account.
+func getUser(password string) (*UserData, error) {
+	res, err := apiCall("GET", "/user?password="+url.QueryEscape(password), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if res["success"] != true {
+		if res["code"] == "USER_NOT_FOUND" {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("%v (%v)", res["message"], res["code"])
+	}
+
+	var user UserData
+	dataBytes, _ := json.Marshal(res["data"])
+	if err := json.Unmarshal(dataBytes, &user); err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
 func getUsers() ([]UserData, error) {
 	res, err := apiCall("GET", "/users", nil)
 	if err != nil {
@@ -3,11 +3,19 @@ package main
 import (
 	"archive/zip"
 	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
 	"encoding/json"
+	"encoding/pem"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
+	"mime"
 	"net/http"
 	"os"
 	"os/exec"
@@ -29,14 +37,21 @@ const (
 	BotConfigFile = "/etc/zivpn/bot-config.json"
 	ApiPortFile   = "/etc/zivpn/api_port"
 	ApiKeyFile    = "/etc/zivpn/apikey"
+	LegacySigningFile = "/etc/zivpn/apikey.signing"
 	DomainFile    = "/etc/zivpn/domain"
 	PortFile	  = "/etc/zivpn/port"
 )
 
-var ApiUrl = "http://127.0.0.1:" + PortFile + "/api"
+var ApiUrl = "http://127.0.0.1:" + PortFile + "/api/v1"
 
 var ApiKey = "AutoFtBot-agskjgdvsbdreiWG1234512SDKrqw"
 
+var ApiKeyID = "legacy"
+var SignRequests = false
+var SigningSecret = ""
+
+var apiClient = &http.Client{}
+
 type BotConfig struct {
 	BotToken      string `json:"bot_token"`
 	AdminID        int64  `json:"admin_id"`
@@ -45,6 +60,11 @@ type BotConfig struct {
 	PakasirSlug    string `json:"pakasir_slug"`
 	PakasirApiKey  string `json:"pakasir_api_key"`
 	DailyPrice     int    `json:"daily_price"`
+	SignRequests   bool   `json:"sign_requests"` // HMAC-signed API requests instead of X-API-Key
+	ApiKeyID       string `json:"api_key_id"`    // Key ID for signing, defaults to "legacy"
+	ApiSigningSecret string `json:"api_signing_secret"` // signing_secret of api_key_id, legacy reads LegacySigningFile
+	ApiTLS         bool   `json:"api_tls"`       // HTTPS to the API, pinning ApiCertFile
+	ApiCertFile    string `json:"api_cert_file"` // Defaults to /etc/zivpn/zivpn.crt
 }
 
 type IpInfo struct {
@@ -79,13 +99,36 @@ func main() {
 	// Load API Port
 	if portBytes, err := ioutil.ReadFile(ApiPortFile); err == nil {
 		port := strings.TrimSpace(string(portBytes))
-		ApiUrl = fmt.Sprintf("http://127.0.0.1:%s/api", port)
+		ApiUrl = fmt.Sprintf("http://127.0.0.1:%s/api/v1", port)
 	}
 
 	config, err := loadConfig()
 	if err != nil {
 		log.Fatal("Gagal memuat konfigurasi bot:", err)
 	}
+	SignRequests = config.SignRequests
+	if config.ApiKeyID != "" {
+		ApiKeyID = config.ApiKeyID
+	}
+	if SignRequests {
+		SigningSecret = config.ApiSigningSecret
+		if SigningSecret == "" && ApiKeyID == "legacy" {
+			if secretBytes, err := ioutil.ReadFile(LegacySigningFile); err == nil {
+				SigningSecret = strings.TrimSpace(string(secretBytes))
+			}
+		}
+		if SigningSecret == "" {
+			log.Fatal("sign_requests aktif tapi signing secret tidak ditemukan (api_signing_secret atau ", LegacySigningFile, ")")
+		}
+	}
+	if config.ApiTLS {
+		ApiUrl = strings.Replace(ApiUrl, "http://", "https://", 1)
+		certFile := config.ApiCertFile
+		if certFile == "" {
+			certFile = "/etc/zivpn/zivpn.crt"
+		}
+		apiClient = newPinnedApiClient(certFile)
+	}
 
 	bot, err := tgbotapi.NewBotAPI(config.BotToken)
 	if err != nil {
@@ -295,6 +338,8 @@ func createUser(bot *tgbotapi.BotAPI, chatID int64, password string, days int, c
 	res, err := apiCall("POST", "/user/create", map[string]interface{}{
 		"password": password,
 		"days":     days,
+		"owner":    strconv.FormatInt(chatID, 10),
+		"plan":     fmt.Sprintf("%d hari", days),
 	})
 
 	if err != nil {
@@ -531,13 +576,25 @@ func performBackup(bot *tgbotapi.BotAPI, chatID int64) {
 	// Files to backup
 	files := []string{
 		"/etc/zivpn/config.json",
-		"/etc/zivpn/users.json",
+		"/etc/zivpn/api-config.json",
+		"/etc/zivpn/apikeys.json",
 		"/etc/zivpn/domain",
 	}
 
 	buf := new(bytes.Buffer)
 	zipWriter := zip.NewWriter(buf)
 
+	// Database user diambil lewat API. users.db tidak boleh disalin langsung
+	// selama API membukanya, hasilnya bisa rusak.
+	dbName, dbData, err := apiDownload("/backup/users")
+	if err != nil {
+		replyError(bot, chatID, "Gagal mengambil database user dari API: "+err.Error())
+		return
+	}
+	if w, err := zipWriter.Create(dbName); err == nil {
+		w.Write(dbData)
+	}
+
 	for _, file := range files {
 		if _, err := os.Stat(file); os.IsNotExist(err) {
 			continue
@@ -624,6 +681,9 @@ func processRestoreFile(bot *tgbotapi.BotAPI, msg *tgbotapi.Message, config *Bot
 		validFiles := map[string]bool{
 			"config.json": true,
 			"users.json": true,
+			"users.db": true,
+			"api-config.json": true,
+			"apikeys.json": true,
 			"bot-config.json": true,
 			"domain": true,
 			"apikey": true,
@@ -693,16 +753,21 @@ func apiCall(method, endpoint string, payload interface{}) (map[string]interface
 		}
 	}
 
-	client := &http.Client{}
 	req, err := http.NewRequest(method, ApiUrl+endpoint, bytes.NewBuffer(reqBody))
 	if err != nil {
 		return nil, err
 	}
 
 	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("X-API-Key", ApiKey)
+	if SignRequests {
+		if err := signApiRequest(req, reqBody); err != nil {
+			return nil, err
+		}
+	} else {
+		req.Header.Set("X-API-Key", ApiKey)
+	}
 
-	resp, err := client.Do(req)
+	resp, err := apiClient.Do(req)
 	if err != nil {
 		return nil, err
 	}
@@ -715,6 +780,91 @@ func apiCall(method, endpoint string, payload interface{}) (map[string]interface
 	return result, nil
 }
 
+// apiDownload fetches a file from the API and returns the file name from
+// Content-Disposition together with its content.
+func apiDownload(endpoint string) (string, []byte, error) {
+	req, err := http.NewRequest(http.MethodGet, ApiUrl+endpoint, nil)
+	if err != nil {
+		return "", nil, err
+	}
+
+	if SignRequests {
+		if err := signApiRequest(req, nil); err != nil {
+			return "", nil, err
+		}
+	} else {
+		req.Header.Set("X-API-Key", ApiKey)
+	}
+
+	resp, err := apiClient.Do(req)
+	if err != nil {
+		return "", nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		var result map[string]interface{}
+		json.Unmarshal(body, &result)
+		return "", nil, fmt.Errorf("%v (%v)", result["message"], result["code"])
+	}
+
+	_, params, err := mime.ParseMediaType(resp.Header.Get("Content-Disposition"))
+	if err != nil || params["filename"] == "" {
+		return "", nil, fmt.Errorf("response %s tanpa nama file", endpoint)
+	}
+	return filepath.Base(params["filename"]), body, nil
+}
+
+// signApiRequest signs req for the API's signed-request mode, keyed with
+// the key's signing secret, so the key itself is never sent.
+func signApiRequest(req *http.Request, body []byte) error {
+	nonceBytes := make([]byte, 16)
+	if _, err := rand.Read(nonceBytes); err != nil {
+		return err
+	}
+	nonce := hex.EncodeToString(nonceBytes)
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+
+	bodyHash := sha256.Sum256(body)
+	mac := hmac.New(sha256.New, []byte(SigningSecret))
+	mac.Write([]byte(req.Method + "\n" + req.URL.RequestURI() + "\n" + timestamp + "\n" + nonce + "\n" + hex.EncodeToString(bodyHash[:])))
+
+	req.Header.Set("X-Key-ID", ApiKeyID)
+	req.Header.Set("X-Timestamp", timestamp)
+	req.Header.Set("X-Nonce", nonce)
+	req.Header.Set("X-Signature", hex.EncodeToString(mac.Sum(nil)))
+	return nil
+}
+
+// newPinnedApiClient trusts exactly the certificate in certFile. The API
+// cert is self-signed for the domain, so it is pinned instead of verified
+// against a CA and hostname. The file is re-read on every handshake so a
+// renewed cert keeps working.
+func newPinnedApiClient(certFile string) *http.Client {
+	return &http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{
+				InsecureSkipVerify: true,
+				VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+					pemBytes, err := ioutil.ReadFile(certFile)
+					if err != nil {
+						return err
+					}
+					block, _ := pem.Decode(pemBytes)
+					if block == nil || len(rawCerts) == 0 || !bytes.Equal(block.Bytes, rawCerts[0]) {
+						return fmt.Errorf("sertifikat API tidak cocok dengan %s", certFile)
+					}
+					return nil
+				},
+			},
+		},
+	}
+}
+
 func getIpInfo() (IpInfo, error) {
 	resp, err := http.Get("http://ip-api.com/json/")
 	if err != nil {